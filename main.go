@@ -4,295 +4,6499 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	_ "embed"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	mssql "github.com/microsoft/go-mssqldb"
 	"github.com/xuri/excelize/v2"
 	"gopkg.in/yaml.v3"
 )
 
+// used when no template path is given, a blank workbook with a single Sheet1
+//
+//go:embed default.xlsx
+var defaultTemplate []byte
+
+// set at build time, e.g. go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.date=$(date -u +%F)"
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+// the commit and date default to the vcs info stamped by go build
+func Version() string {
+	rev, stamp := commit, date
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && rev == "":
+				rev = setting.Value
+				if len(rev) > 7 {
+					rev = rev[:7]
+				}
+			case setting.Key == "vcs.time" && stamp == "":
+				stamp = setting.Value
+			}
+		}
+	}
+
+	res := version
+	if rev != "" {
+		res += " (" + rev
+		if stamp != "" {
+			res += ", " + stamp
+		}
+		res += ")"
+	}
+
+	return res
+}
+
+type Source struct {
+	Name         string
+	Label        string
+	OutputName   string `yaml:"output-name" json:"output-name"`
+	Options      map[string]string
+	MaxOpenConns int `yaml:"max-open-conns" json:"max-open-conns"`
+	MaxIdleConns int `yaml:"max-idle-conns" json:"max-idle-conns"`
+	Attach       []Attach
+	Partition    Partition
+	Partitions   []Partition
+}
+
+type Attach struct {
+	Path  string
+	Alias string
+}
+
 type Partition struct {
-	Type  string
-	Begin string
-	End   string
+	Name         string
+	Type         string
+	Begin        string
+	End          string
+	WeekStart    string `yaml:"week-start" json:"week-start"`
+	FiscalStart  int    `yaml:"fiscal-start" json:"fiscal-start"`
+	Interval     string
+	Column       string
+	Table        string
+	Values       []string
+	EndInclusive *bool `yaml:"end-inclusive" json:"end-inclusive"`
+	Timezone     string
+}
+
+type Part struct {
+	Begin time.Time
+	End   time.Time
+	Value string
+	Dims  []Dim
+}
+
+// a dimension of a composite partition, for the {part.name} tokens
+type Dim struct {
+	Name string
+	Part Part
 }
 
 type Variable struct {
+	Sheet string
 	Row   int
 	Col   int
 	Value string
 }
 
+type Comment struct {
+	Sheet  string
+	Cell   string
+	Text   string
+	Author string
+}
+
+type Style struct {
+	Bold   bool
+	Italic bool
+	Color  string
+	Fill   string
+	Format string
+}
+
 type Totalization struct {
+	Query   string
+	Col     int
+	Row     int
+	Offset  int
+	Formula string
+	Func    string
+	Format  string
+	Style   *Style
+}
+
+type Properties struct {
+	Title       string
+	Subject     string
+	Author      string
+	Keywords    string
+	Description string
+	Category    string
+	Language    string
+}
+
+type ComputedColumn struct {
 	Col     int
 	Formula string
+	Format  string
+}
+
+type ConditionalFormat struct {
+	Col     int
+	Compare string
+	Value   string
+	Min     string
+	Max     string
+	Style   Style
+}
+
+type Pivot struct {
+	Row   string
+	Col   string
+	Value string
+}
+
+type Protection struct {
+	Password string
+	Allow    []string
+}
+
+type Chart struct {
+	Type     string
+	Title    string
+	Cell     string
+	Category int
+	Series   []int
+}
+
+type Query struct {
+	Name  string
+	Query string
+	Sheet string
+	Row   int `yaml:"start-row" json:"start-row"`
+	Col   int `yaml:"start-col" json:"start-col"`
+}
+
+type Target struct {
+	Sheet string
+	Row   int `yaml:"start-row" json:"start-row"`
+	Col   int `yaml:"start-col" json:"start-col"`
+}
+
+type Column struct {
+	Col    int
+	Type   string
+	Layout string
+	Align  string
+	Format string
+	Width  float64
+	Blob   string
+}
+
+type Result struct {
+	Partition string
+	Begin     string
+	End       string
+	File      string
+	Copy      string
+	Sheet     string
+	Rows      int
+	Columns   []int
+	Totals    []Total
+}
+
+type ManifestFile struct {
+	File      string `json:"file"`
+	Sheet     string `json:"sheet,omitempty"`
+	Partition string `json:"partition,omitempty"`
+	Begin     string `json:"begin,omitempty"`
+	End       string `json:"end,omitempty"`
+	Rows      int    `json:"rows"`
+	Bytes     int64  `json:"bytes"`
+}
+
+type Manifest struct {
+	Files      []ManifestFile `json:"files"`
+	Partitions int            `json:"partitions"`
+	Rows       int            `json:"rows"`
+}
+
+// Failures are the partitions or sources that failed while the rest went on
+type Failures []error
+
+func (f Failures) Error() string {
+	return errors.Join(f...).Error()
+}
+
+type Total struct {
+	Name  string
+	Value interface{}
 }
 
 type Config struct {
-	Input struct {
-		Type    string
-		Sources []struct {
-			Name      string
-			Partition Partition
-		}
+	DryRun          bool `yaml:"dry-run" json:"dry-run"`
+	ContinueOnError bool `yaml:"continue-on-error" json:"continue-on-error"`
+	Progress        bool
+	Workers         int
+	Variables       map[string]string
+	Input           struct {
+		Type       string
+		Sources    []Source
 		Query      string
-		TimeFormat string `yaml:"time-format"`
+		Queries    []Query
+		TimeFormat string `yaml:"time-format" json:"time-format"`
+		Bind       bool
+		Timeout    string
+		Retries    int
 	}
 	Output struct {
-		Name          string
-		Variables     []Variable
-		Totalizations []Totalization
+		Name               string
+		Dir                string
+		TimeFormat         string `yaml:"time-format" json:"time-format"`
+		Type               string
+		Formats            []string
+		Mode               string
+		SheetName          string `yaml:"sheet-name" json:"sheet-name"`
+		Header             bool
+		HeaderNames        []string `yaml:"header-names" json:"header-names"`
+		SkipEmpty          bool     `yaml:"skip-empty" json:"skip-empty"`
+		Stream             bool
+		Limit              int
+		MaxRowsPerSheet    int     `yaml:"max-rows-per-sheet" json:"max-rows-per-sheet"`
+		NullText           string  `yaml:"null-text" json:"null-text"`
+		AutoFit            bool    `yaml:"auto-fit" json:"auto-fit"`
+		MaxWidth           float64 `yaml:"max-width" json:"max-width"`
+		FreezeHeader       bool    `yaml:"freeze-header" json:"freeze-header"`
+		FreezePanes        string  `yaml:"freeze-panes" json:"freeze-panes"`
+		Table              bool
+		AutoFilter         bool `yaml:"auto-filter" json:"auto-filter"`
+		Protect            *Protection
+		TableStyle         string              `yaml:"table-style" json:"table-style"`
+		ConditionalFormats []ConditionalFormat `yaml:"conditional-formats" json:"conditional-formats"`
+		Charts             []Chart
+		Index              bool
+		Summary            bool
+		PreserveFooter     bool   `yaml:"preserve-footer" json:"preserve-footer"`
+		SkipExisting       bool   `yaml:"skip-existing" json:"skip-existing"`
+		PostCommand        string `yaml:"post-command" json:"post-command"`
+		LogFile            string `yaml:"log-file" json:"log-file"`
+		MergeSources       bool   `yaml:"merge-sources" json:"merge-sources"`
+		SourceColumn       string `yaml:"source-column" json:"source-column"`
+		Pivot              *Pivot
+		Properties         *Properties
+		Columns            []Column
+		ComputedColumns    []ComputedColumn `yaml:"computed-columns" json:"computed-columns"`
+		Variables          []Variable
+		Comments           []Comment
+		Totalizations      []Totalization
 	}
 	Template struct {
-		Path  string
-		Sheet string
-		Row   int `yaml:"start-row"`
-		Col   int `yaml:"start-col"`
+		Path       string
+		Sheet      string
+		Row        int    `yaml:"start-row" json:"start-row"`
+		Col        int    `yaml:"start-col" json:"start-col"`
+		NamedRange string `yaml:"named-range" json:"named-range"`
+		Targets    []Target
 	}
 }
 
-func LoadConfig(
-	File string,
-) (Config, error) {
-	cfg := Config{}
-
-	data, err := os.ReadFile(File)
-	if err != nil {
-		return cfg, err
-	}
+type SplitSheet struct {
+	Name string
+	Last int
+}
 
-	err = yaml.Unmarshal(data, &cfg)
-	if err != nil {
-		return cfg, err
-	}
+type Capture struct {
+	Names []string
+	Rows  [][]interface{}
+}
 
-	return cfg, nil
+// PartitionState holds what is gathered while a partition is written, apart
+// from the config, which every query and worker gets its own copy of
+type PartitionState struct {
+	// the label of the source being written, for the source column
+	Source string
+	// the rows scanned for the csv copy of the xlsx output, if any
+	Capture *Capture
+	// the sheets filled before the current one when splitting a query
+	Split []SplitSheet
 }
 
-func OpenDb(
-	name string,
-) (*sqlx.DB, error) {
-	db, err := sqlx.Connect("sqlite3", name)
-	if err != nil {
-		return nil, err
+func ReadConfig(
+	file string,
+) ([]byte, error) {
+	if file == "-" {
+		return io.ReadAll(os.Stdin)
 	}
 
-	return db, nil
+	return os.ReadFile(file)
 }
 
-func LoadTemplate(
-	path string,
-) (*excelize.File, error) {
-	tpl, err := excelize.OpenFile(path)
-	if err != nil {
-		return tpl, err
+// yaml is a superset of json, but json.Unmarshal reports json syntax errors better
+func DecodeConfig(
+	file string,
+	data []byte,
+	out interface{},
+) error {
+	if strings.EqualFold(filepath.Ext(file), ".json") {
+		return json.Unmarshal(data, out)
 	}
 
-	defer func() {
-		_ = tpl.Close()
-	}()
-
-	return tpl, nil
+	return yaml.Unmarshal(data, out)
 }
 
-func CreatePartitions(
-	part Partition,
-) ([]time.Time, error) {
-	res := []time.Time{}
-
-	begin, err := time.Parse("2006-01-02T15:04:05", part.Begin+"T00:00:00")
-	if err != nil {
-		return res, err
+// the later files override the scalar settings of the earlier ones and extend
+// their lists, e.g. a shared base with the connection and template and a file
+// per report with its queries; the yaml nodes keep the scalars as written, so
+// the dates aren't turned into timestamps
+func MergeConfig(
+	base *yaml.Node,
+	over *yaml.Node,
+) *yaml.Node {
+	// an empty file leaves the base as it is
+	if over.Kind == 0 {
+		return base
 	}
-	end, err := time.Parse("2006-01-02T15:04:05", part.End+"T23:59:59")
-	if err != nil {
-		return res, err
+	if base == nil || base.Kind != over.Kind {
+		return over
 	}
-	var adder func(time.Time) time.Time
 
-	switch part.Type {
-	case "day", "daily":
-		adder = func(cur time.Time) time.Time { return cur.AddDate(0, 0, 1) }
-	case "month", "monthly":
-		adder = func(cur time.Time) time.Time { return cur.AddDate(0, 1, 0) }
-	case "year", "yearly":
-		adder = func(cur time.Time) time.Time { return cur.AddDate(1, 0, 0) }
+	switch over.Kind {
+	case yaml.DocumentNode:
+		if len(base.Content) == 0 {
+			return over
+		}
+		if len(over.Content) > 0 {
+			base.Content[0] = MergeConfig(base.Content[0], over.Content[0])
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(over.Content); i += 2 {
+			key, value := over.Content[i], over.Content[i+1]
+			found := false
+			for j := 0; j+1 < len(base.Content); j += 2 {
+				if base.Content[j].Value == key.Value {
+					base.Content[j+1] = MergeConfig(base.Content[j+1], value)
+					found = true
+					break
+				}
+			}
+			if !found {
+				base.Content = append(base.Content, key, value)
+			}
+		}
+	case yaml.SequenceNode:
+		base.Content = append(base.Content, over.Content...)
 	default:
-		return res, errors.New("unsupported partition type")
+		return over
 	}
 
-	cur := begin
-	for ; cur.Before(end); cur = adder(cur) {
-		res = append(res, cur)
+	return base
+}
+
+func LoadConfig(
+	files ...string,
+) (Config, error) {
+	cfg := Config{}
+
+	var merged *yaml.Node
+	for _, file := range files {
+		data, err := ReadConfig(file)
+		if err != nil {
+			return cfg, err
+		}
+
+		if len(files) == 1 {
+			err = DecodeConfig(file, data, &cfg)
+			if err != nil {
+				return cfg, err
+			}
+			break
+		}
+
+		doc := &yaml.Node{}
+		err = yaml.Unmarshal(data, doc)
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %w", file, err)
+		}
+		merged = MergeConfig(merged, doc)
 	}
-	res = append(res, cur)
 
-	return res, nil
-}
+	if merged != nil {
+		err := merged.Decode(&cfg)
+		if err != nil {
+			return cfg, err
+		}
+	}
 
-func CloneTemplate(
-	cfg Config,
-	num int,
-	begin string,
-	end string,
-) (*excelize.File, error) {
-	input, err := ioutil.ReadFile(cfg.Template.Path)
+	err := cfg.ExpandEnv()
 	if err != nil {
-		return nil, err
+		return cfg, err
 	}
 
-	dst := strings.ReplaceAll(
-		strings.ReplaceAll(
-			strings.ReplaceAll(
-				cfg.Output.Name,
-				"{num}",
-				fmt.Sprint(num),
-			),
-			"{part.beg}",
-			begin),
-		"{part.end}",
-		end,
-	) + ".xlsx"
-
-	err = ioutil.WriteFile(dst, input, 0644)
+	cfg.Input.Query, err = ReadQuery(cfg.Input.Query)
 	if err != nil {
-		return nil, err
+		return cfg, err
+	}
+	for i := range cfg.Input.Queries {
+		cfg.Input.Queries[i].Query, err = ReadQuery(cfg.Input.Queries[i].Query)
+		if err != nil {
+			return cfg, err
+		}
 	}
 
-	return LoadTemplate(dst)
-}
+	if strings.Contains(cfg.Input.TimeFormat, "%") {
+		cfg.Input.TimeFormat = strftimeLayout.Replace(cfg.Input.TimeFormat)
+	}
+	// the file names and variables follow the query format unless they have their own
+	if cfg.Output.TimeFormat == "" {
+		cfg.Output.TimeFormat = cfg.Input.TimeFormat
+	} else if strings.Contains(cfg.Output.TimeFormat, "%") {
+		cfg.Output.TimeFormat = strftimeLayout.Replace(cfg.Output.TimeFormat)
+	}
+	for i, col := range cfg.Output.Columns {
+		if strings.Contains(col.Layout, "%") {
+			cfg.Output.Columns[i].Layout = strftimeLayout.Replace(col.Layout)
+		}
+	}
 
-func Process(
-	cfg Config,
-	db *sqlx.DB,
-	total int,
-	partitions []time.Time,
-) error {
-	ExcelCols := []string{
-		"A", "B", "C", "D", "E", "F", "G", "H", "I", "J", "K", "L", "M", "N", "O", "P", "Q", "R", "S", "T", "U", "V", "W", "X", "Y", "Z",
-		"AA", "AB", "AC", "AD", "AE", "AF", "AG", "AH", "AI", "AJ", "AK", "AL", "AM", "AN", "AO", "AP", "AQ", "AR", "AS", "AT", "AU", "AV", "AW", "AX", "AY", "AZ",
+	// a single format is just the output type, while with both the csv
+	// files are copies of the data written to the xlsx ones
+	if len(cfg.Output.Formats) > 0 && cfg.Output.Type == "" {
+		cfg.Output.Type = "csv"
+		if slices.Contains(cfg.Output.Formats, "xlsx") {
+			cfg.Output.Type = "xlsx"
+		}
 	}
 
-	for p := 0; p < len(partitions)-1; p++ {
-		begin := partitions[p].Format(cfg.Input.TimeFormat)
-		end := partitions[p+1].AddDate(0, 0, -1).Format(cfg.Input.TimeFormat)
+	// the default template is filled from its top left cell, below the header if any
+	if cfg.Template.Path == "" {
+		if cfg.Template.Sheet == "" {
+			cfg.Template.Sheet = "Sheet1"
+		}
+		if cfg.Template.Row == 0 {
+			cfg.Template.Row = 1
+			if cfg.Output.Header {
+				cfg.Template.Row = 2
+			}
+		}
+		if cfg.Template.Col == 0 {
+			cfg.Template.Col = 1
+		}
+	}
 
-		tpl, err := CloneTemplate(cfg, total+p, begin, end)
-		if err != nil {
-			return err
+	// the file sources are queried through their data table
+	if cfg.Input.Type == "csv" || cfg.Input.Type == "ndjson" {
+		if strings.TrimSpace(cfg.Input.Query) == "" && len(cfg.Input.Queries) == 0 {
+			cfg.Input.Query = "select * from " + fileSourceTable
+		}
+		for i := range cfg.Input.Sources {
+			source := &cfg.Input.Sources[i]
+			for _, part := range append([]*Partition{&source.Partition}, PartitionRefs(source.Partitions)...) {
+				if part.Type == "column" && part.Table == "" {
+					part.Table = fileSourceTable
+				}
+			}
 		}
+	}
 
-		query := strings.ReplaceAll(strings.ReplaceAll(cfg.Input.Query, "{part.beg}", begin), "{part.end}", end)
-		rows, err := db.Queryx(query)
+	if cfg.Template.NamedRange != "" {
+		err = cfg.ResolveNamedRange()
 		if err != nil {
-			return err
+			return cfg, err
 		}
+	}
 
-		fmt.Printf("Processing partition: %s to %s\n", begin, end)
+	err = cfg.Validate()
+	if err != nil {
+		return cfg, err
+	}
 
-		r := int(cfg.Template.Row)
-		for rows.Next() {
-			cols, err := rows.SliceScan()
-			if err != nil {
-				return err
-			}
+	return cfg, nil
+}
 
-			/*err = tpl.DuplicateRowTo(cfg.Template.Sheet, cfg.Template.Row, r)
-			if err != nil {
-				return err
-			}*/
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
 
-			c := cfg.Template.Col - 1
-			axis := ExcelCols[c] + fmt.Sprint(r)
-			err = tpl.SetSheetRow(cfg.Template.Sheet, axis, &cols)
+// ExpandEnv replaces the ${NAME} references in the connection, path and name
+// settings with the environment variables, so secrets can stay out of the config
+func (cfg *Config) ExpandEnv() error {
+	fields := []*string{
+		&cfg.Output.Name,
+		&cfg.Output.Dir,
+		&cfg.Output.PostCommand,
+		&cfg.Template.Path,
+	}
+	if cfg.Output.Protect != nil {
+		fields = append(fields, &cfg.Output.Protect.Password)
+	}
+	for i := range cfg.Input.Sources {
+		source := &cfg.Input.Sources[i]
+		fields = append(fields, &source.Name, &source.Label, &source.OutputName)
+		for j := range source.Attach {
+			fields = append(fields, &source.Attach[j].Path)
+		}
+		for key, value := range source.Options {
+			value, err := ExpandEnv(value)
 			if err != nil {
 				return err
 			}
-
-			r++
+			source.Options[key] = value
 		}
+	}
 
-		for _, variable := range cfg.Output.Variables {
-			c := variable.Col - 1
-			axis := ExcelCols[c] + fmt.Sprint(variable.Row)
-			value := strings.ReplaceAll(
-				strings.ReplaceAll(
-					variable.Value, "{part.beg}", begin,
-				),
-				"{part.end}",
-				end,
-			)
-			_ = tpl.SetCellStr(cfg.Template.Sheet, axis, value)
+	for _, field := range fields {
+		value, err := ExpandEnv(*field)
+		if err != nil {
+			return err
 		}
+		*field = value
+	}
 
-		if len(cfg.Output.Totalizations) > 0 {
-			err := tpl.InsertRow(cfg.Template.Sheet, r)
-			if err != nil {
-				return err
-			}
-		}
+	return nil
+}
 
-		for _, tot := range cfg.Output.Totalizations {
-			c := tot.Col - 1
-			axis := ExcelCols[c] + fmt.Sprint(r)
-			lastRow := fmt.Sprint(r - 1)
-			formula := strings.ReplaceAll(
-				tot.Formula, "{rows.last}", lastRow,
-			)
-			style, _ := tpl.GetCellStyle(cfg.Template.Sheet, ExcelCols[c]+lastRow)
-			_ = tpl.SetCellFormula(cfg.Template.Sheet, axis, formula)
-			_ = tpl.SetCellStyle(cfg.Template.Sheet, axis, axis, style)
+func ExpandEnv(
+	value string,
+) (string, error) {
+	var err error
+	res := envPattern.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envPattern.FindStringSubmatch(ref)[1]
+		env, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
 		}
+		return env
+	})
+
+	return res, err
+}
+
+// strftime directives accepted in the time format, converted to the Go layout
+var strftimeLayout = strings.NewReplacer(
+	"%Y", "2006",
+	"%y", "06",
+	"%m", "01",
+	"%d", "02",
+	"%e", "_2",
+	"%j", "002",
+	"%H", "15",
+	"%I", "03",
+	"%M", "04",
+	"%S", "05",
+	"%p", "PM",
+	"%b", "Jan",
+	"%B", "January",
+	"%a", "Mon",
+	"%A", "Monday",
+	"%z", "-0700",
+	"%Z", "MST",
+	"%%", "%",
+)
 
-		tpl.Save()
-		tpl.Close()
+// a query starting with @ is the path of a .sql file holding the query
+func ReadQuery(
+	query string,
+) (string, error) {
+	if !strings.HasPrefix(query, "@") {
+		return query, nil
+	}
 
-		rows.Close()
+	data, err := os.ReadFile(query[1:])
+	if err != nil {
+		return "", fmt.Errorf("reading query file: %w", err)
 	}
 
-	return nil
+	return string(data), nil
 }
 
-func main() {
-	fmt.Println("sql2excel - Exports partitioned SQL query results to Microsoft Excel using a template")
-	fmt.Println("Copyright 2022 by André Vicentini")
+var dimNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
 
-	if len(os.Args) != 2 {
-		log.Fatalf("Error: the yaml config file name must be passed as argument")
-	}
+var aliasPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// the names taken by the partition tokens of the queries
+var reservedDims = map[string]bool{"beg": true, "end": true, "value": true, "num": true, "index": true}
+
+func (cfg Config) Validate() error {
+	// every problem is reported, not only the first one
+	problems := []error{}
 
-	cfg, err := LoadConfig(os.Args[1])
+	_, err := DriverName(cfg.Input.Type)
 	if err != nil {
-		log.Fatalf("Error: %v", err)
+		problems = append(problems, err)
+	}
+
+	if len(cfg.Input.Queries) == 0 && strings.TrimSpace(cfg.Input.Query) == "" {
+		problems = append(problems, errors.New("input query must not be empty"))
+	}
+	for _, query := range cfg.Input.Queries {
+		if strings.TrimSpace(query.Query) == "" {
+			problems = append(problems, fmt.Errorf("input query %s must not be empty", query.Name))
+		}
+	}
+
+	// a layout without any of the Go reference time elements formats to itself
+	if cfg.Input.TimeFormat != "" {
+		sample := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC).Format(cfg.Input.TimeFormat)
+		if sample == cfg.Input.TimeFormat {
+			problems = append(problems, fmt.Errorf("input time-format %s has no date or time elements, use Go's reference time layout, e.g. 2006-01-02 15:04:05", cfg.Input.TimeFormat))
+		}
+	}
+	if cfg.Output.TimeFormat != "" && cfg.Output.TimeFormat != cfg.Input.TimeFormat {
+		sample := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC).Format(cfg.Output.TimeFormat)
+		if sample == cfg.Output.TimeFormat {
+			problems = append(problems, fmt.Errorf("output time-format %s has no date or time elements, use Go's reference time layout, e.g. Jan-2006", cfg.Output.TimeFormat))
+		}
+	}
+
+	// the csv and ndjson inputs run on sqlite3 too, but have no database file to attach to
+	driver, _ := DriverName(cfg.Input.Type)
+	sqliteFile := driver == "sqlite3" && cfg.Input.Type != "csv" && cfg.Input.Type != "ndjson"
+	for _, source := range cfg.Input.Sources {
+		for _, attach := range source.Attach {
+			if !sqliteFile {
+				problems = append(problems, fmt.Errorf("source %s attaches databases, which requires the sqlite3 input type", SourceLabel(cfg.Input.Type, source)))
+			}
+			if attach.Path == "" || !aliasPattern.MatchString(attach.Alias) {
+				problems = append(problems, fmt.Errorf("the attached databases of source %s need a path and an alias of letters, digits and underscores", SourceLabel(cfg.Input.Type, source)))
+			}
+		}
 	}
 
-	total := 1
 	for _, source := range cfg.Input.Sources {
-		db, err := OpenDb(source.Name)
+		if len(source.Partitions) == 0 {
+			continue
+		}
+		if source.Partition.Type != "" {
+			problems = append(problems, fmt.Errorf("source %s has both a partition and partitions", SourceLabel(cfg.Input.Type, source)))
+		}
+		names := map[string]bool{}
+		for _, part := range source.Partitions {
+			if !dimNamePattern.MatchString(part.Name) || reservedDims[part.Name] {
+				problems = append(problems, fmt.Errorf("the partitions of source %s need a name of letters, digits and underscores, other than beg, end, value, num and index, got %q", SourceLabel(cfg.Input.Type, source), part.Name))
+			}
+			if names[part.Name] {
+				problems = append(problems, fmt.Errorf("duplicate partition name in source %s: %s", SourceLabel(cfg.Input.Type, source), part.Name))
+			}
+			names[part.Name] = true
+		}
+	}
+
+	for _, cond := range cfg.Output.ConditionalFormats {
+		if _, ok := compareCriteria[cond.Compare]; !ok {
+			problems = append(problems, fmt.Errorf("conditional format of column %d needs one of the lt, le, gt, ge, eq, ne or between comparisons", cond.Col))
+		}
+		if cond.Col < 1 {
+			problems = append(problems, fmt.Errorf("conditional format col must be at least 1, got %d", cond.Col))
+		}
+	}
+
+	for _, chart := range cfg.Output.Charts {
+		if chart.Type == "" || chart.Category < 1 || len(chart.Series) == 0 {
+			problems = append(problems, errors.New("output charts need a type, a category col and at least one series col"))
+		}
+		_, _, err = excelize.CellNameToCoordinates(chart.Cell)
 		if err != nil {
-			log.Fatalf("Error: %v", err)
+			problems = append(problems, fmt.Errorf("invalid chart cell: %w", err))
 		}
+	}
 
-		partitions, err := CreatePartitions(source.Partition)
+	if cfg.Output.Table && cfg.Template.Row <= 1 {
+		problems = append(problems, errors.New("the output table requires start-row to be greater than 1, for its header row"))
+	}
+	if cfg.Output.AutoFilter && cfg.Template.Row <= 1 {
+		problems = append(problems, errors.New("the output auto-filter requires start-row to be greater than 1, for its header row"))
+	}
+	if cfg.Output.AutoFilter && cfg.Output.Table {
+		problems = append(problems, errors.New("output auto-filter can't be combined with table, as tables have their own filter"))
+	}
+
+	if cfg.Output.FreezePanes != "" {
+		_, _, err = excelize.CellNameToCoordinates(cfg.Output.FreezePanes)
 		if err != nil {
-			log.Fatalf("Error: %v", err)
+			problems = append(problems, fmt.Errorf("invalid output freeze-panes: %w", err))
 		}
+	}
 
-		err = Process(cfg, db, total, partitions)
+	for _, comment := range cfg.Output.Comments {
+		_, _, err = excelize.CellNameToCoordinates(comment.Cell)
 		if err != nil {
-			log.Fatalf("Error: %v", err)
+			problems = append(problems, fmt.Errorf("invalid comment cell: %w", err))
 		}
+	}
 
-		db.Close()
+	if cfg.Output.Protect != nil {
+		locks := SheetLocks(&excelize.FormatSheetProtection{})
+		for _, op := range cfg.Output.Protect.Allow {
+			if _, ok := locks[op]; !ok {
+				problems = append(problems, fmt.Errorf("unsupported output protect operation: %s", op))
+			}
+		}
+	}
+
+	if cfg.Output.Summary && cfg.Output.Stream {
+		problems = append(problems, errors.New("output summary is not supported in stream mode, as the totals of the streamed rows are only computed by Excel"))
+	}
+	if cfg.Output.Summary && cfg.Output.MergeSources {
+		problems = append(problems, errors.New("output summary is not supported with merge-sources"))
+	}
+	if cfg.Output.Summary && cfg.Output.MaxRowsPerSheet > 0 {
+		problems = append(problems, errors.New("output summary is not supported with max-rows-per-sheet, as the totals are split across sheets"))
+	}
+
+	for _, variable := range cfg.Output.Variables {
+		if cfg.Output.Stream && aggTokens.MatchString(variable.Value) {
+			problems = append(problems, fmt.Errorf("the {agg...} tokens of variable %s are not supported in stream mode, as the variables are written before the rows", variable.Value))
+		}
+	}
+
+	if cfg.Output.PreserveFooter && cfg.Output.Stream {
+		problems = append(problems, errors.New("output preserve-footer is not supported in stream mode, as the template rows below start-row are dropped"))
+	}
+
+	if cfg.Output.AutoFit && cfg.Output.Stream {
+		problems = append(problems, errors.New("output auto-fit is not supported in stream mode, as the widths must be set before the rows"))
+	}
 
-		total += len(partitions) - 1
+	if cfg.Output.Limit < 0 {
+		problems = append(problems, fmt.Errorf("output limit must not be negative, got %d", cfg.Output.Limit))
 	}
 
+	if cfg.Input.Timeout != "" {
+		_, err = time.ParseDuration(cfg.Input.Timeout)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("invalid input timeout: %s", cfg.Input.Timeout))
+		}
+	}
+
+	if cfg.Output.PostCommand != "" {
+		_, err = SplitWords(cfg.Output.PostCommand)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("output post-command: %w", err))
+		}
+	}
+
+	if cfg.Output.Name == "-" {
+		switch {
+		case cfg.Output.Mode == "inplace", cfg.Output.SkipExisting, cfg.Output.PostCommand != "", cfg.Output.MergeSources:
+			problems = append(problems, errors.New("the output name - (stdout) is not supported with the inplace mode, skip-existing, post-command or merge-sources"))
+		case strings.HasPrefix(strings.ToLower(filepath.Ext(cfg.Template.Path)), ".xlt"):
+			problems = append(problems, errors.New("the output name - (stdout) requires an xlsx or xlsm template, as the template type is kept"))
+		}
+	}
+
+	for i, format := range cfg.Output.Formats {
+		if format != "xlsx" && format != "csv" {
+			problems = append(problems, fmt.Errorf("unsupported output format: %s", format))
+		}
+		if slices.Contains(cfg.Output.Formats[:i], format) {
+			problems = append(problems, fmt.Errorf("duplicate output format: %s", format))
+		}
+	}
+	typ := cfg.Output.Type
+	if typ == "" {
+		typ = "xlsx"
+	}
+	if len(cfg.Output.Formats) > 0 && !slices.Contains(cfg.Output.Formats, typ) {
+		problems = append(problems, fmt.Errorf("the output type %s is not one of the output formats", typ))
+	}
+	if CsvCopy(cfg) {
+		switch {
+		case cfg.Output.Mode == "sheets", cfg.Output.MergeSources, cfg.Output.Name == "-":
+			problems = append(problems, errors.New("the csv copies of the output formats are not supported with the sheets mode, merge-sources or stdout"))
+		case len(QueryConfigs(cfg)) > 1:
+			problems = append(problems, errors.New("the csv copies of the output formats require a single query"))
+		}
+	}
+
+	if p := cfg.Output.Pivot; p != nil {
+		if p.Row == "" || p.Col == "" || p.Value == "" || p.Row == p.Col || p.Row == p.Value || p.Col == p.Value {
+			problems = append(problems, errors.New("output pivot needs three distinct row, col and value query columns"))
+		}
+	}
+
+	if cfg.Output.MaxRowsPerSheet < 0 {
+		problems = append(problems, errors.New("output max-rows-per-sheet must not be negative"))
+	}
+
+	// the column types and blob handling also apply to the csv output
+	for _, col := range cfg.Output.Columns {
+		switch col.Type {
+		case "", "auto", "string", "text", "int", "integer", "float", "number", "date", "datetime":
+		default:
+			problems = append(problems, fmt.Errorf("unsupported column type: %s", col.Type))
+		}
+		if col.Layout != "" && col.Type != "date" && col.Type != "datetime" {
+			problems = append(problems, fmt.Errorf("the layout of column %d requires the date or datetime type", col.Col))
+		}
+		switch col.Align {
+		case "", "left", "center", "right", "fill", "justify", "distributed", "general":
+		default:
+			problems = append(problems, fmt.Errorf("unsupported align of column %d: %s (left, center, right, fill, justify, distributed or general)", col.Col, col.Align))
+		}
+		if col.Width < 0 {
+			problems = append(problems, fmt.Errorf("the width of column %d must not be negative", col.Col))
+		}
+		switch col.Blob {
+		case "", "base64", "hex", "length", "skip":
+		default:
+			problems = append(problems, fmt.Errorf("unsupported blob handling of column %d: %s (base64, hex, length or skip)", col.Col, col.Blob))
+		}
+	}
+
+	switch cfg.Output.Type {
+	case "", "xlsx":
+	case "csv":
+		if cfg.Output.MaxRowsPerSheet > 0 {
+			problems = append(problems, errors.New("output max-rows-per-sheet requires the xlsx output type"))
+		}
+		if cfg.Output.Mode == "sheets" || cfg.Output.Mode == "inplace" {
+			problems = append(problems, fmt.Errorf("the %s output mode requires the xlsx output type", cfg.Output.Mode))
+		}
+		if len(QueryConfigs(cfg)) > 1 {
+			problems = append(problems, errors.New("the csv output type supports a single query"))
+		}
+		if cfg.Output.MergeSources {
+			problems = append(problems, errors.New("output merge-sources requires the xlsx output type"))
+		}
+	default:
+		problems = append(problems, fmt.Errorf("unsupported output type: %s", cfg.Output.Type))
+	}
+
+	if IsRemote(cfg.Output.Dir) && (cfg.Output.Mode == "inplace" || cfg.Output.SkipExisting) {
+		problems = append(problems, errors.New("a remote output dir is not supported with the inplace mode or skip-existing"))
+	}
+
+	if cfg.Output.SheetName != "" && cfg.Output.Mode != "sheets" {
+		problems = append(problems, errors.New("output sheet-name requires the sheets mode"))
+	}
+
+	if cfg.Output.SkipExisting && (cfg.Output.Mode == "sheets" || cfg.Output.Mode == "inplace") {
+		problems = append(problems, fmt.Errorf("output skip-existing is not supported in %s mode", cfg.Output.Mode))
+	}
+
+	switch cfg.Output.Mode {
+	case "", "files", "inplace":
+	case "sheets":
+		if len(QueryConfigs(cfg)) > 1 {
+			problems = append(problems, errors.New("the sheets output mode supports a single query"))
+		}
+	default:
+		problems = append(problems, fmt.Errorf("unsupported output mode: %s", cfg.Output.Mode))
+	}
+
+	if cfg.Output.MergeSources {
+		if cfg.Output.Mode != "" && cfg.Output.Mode != "files" {
+			problems = append(problems, fmt.Errorf("output merge-sources is not supported in %s mode", cfg.Output.Mode))
+		}
+		if len(QueryConfigs(cfg)) > 1 {
+			problems = append(problems, errors.New("output merge-sources supports a single query"))
+		}
+		// excel compares the sheet names ignoring the case
+		sheets := map[string]string{strings.ToLower(cfg.Template.Sheet): "the template"}
+		for _, source := range cfg.Input.Sources {
+			label := SourceLabel(cfg.Input.Type, source)
+			sheet := strings.ToLower(SanitizeSheetName(label))
+			if other, ok := sheets[sheet]; ok {
+				problems = append(problems, fmt.Errorf("source %s and %s both write to sheet %s with output merge-sources, give them distinct labels", label, other, SanitizeSheetName(label)))
+			}
+			sheets[sheet] = "source " + label
+		}
+	}
+
+	for _, comp := range cfg.Output.ComputedColumns {
+		if comp.Col < 1 || strings.TrimSpace(comp.Formula) == "" {
+			problems = append(problems, errors.New("output computed-columns need a col of at least 1 and a formula, e.g. =(C{row}-D{row})/C{row}"))
+		}
+	}
+
+	if len(cfg.Template.Targets) > 0 && len(cfg.Input.Queries) > 0 {
+		problems = append(problems, errors.New("template targets are for the single input query, set the sheet, start-row and start-col of each input query instead"))
+	}
+
+	// the csv output has no template, nor its totalizations
+	if cfg.Output.Type != "csv" {
+		for _, tot := range cfg.Output.Totalizations {
+			if tot.Offset < 0 {
+				problems = append(problems, fmt.Errorf("totalization of column %d has a negative offset", tot.Col))
+			}
+			if tot.Row != 0 {
+				switch {
+				case tot.Row < 0 || tot.Offset > 0:
+					problems = append(problems, fmt.Errorf("totalization of column %d needs either a row of at least 1 or an offset", tot.Col))
+				case cfg.Output.Stream:
+					problems = append(problems, fmt.Errorf("totalization of column %d has a fixed row, which is not supported in stream mode", tot.Col))
+				case tot.Row == cfg.Template.Row, tot.Row > cfg.Template.Row && !cfg.Output.PreserveFooter:
+					problems = append(problems, fmt.Errorf("totalization of column %d must have its row above start-row %d, or below it in the footer with preserve-footer", tot.Col, cfg.Template.Row))
+				}
+			}
+			if tot.Formula != "" {
+				continue
+			}
+			if _, ok := totalizationFuncs[tot.Func]; !ok {
+				problems = append(problems, fmt.Errorf("totalization of column %d needs a formula or one of the sum, avg, count, min or max funcs", tot.Col))
+			}
+		}
+
+		if cfg.Template.Path != "" {
+			if _, ok := templateExts[strings.ToLower(filepath.Ext(cfg.Template.Path))]; !ok {
+				problems = append(problems, fmt.Errorf("unsupported template type: %s (xlsx, xltx, xlsm or xltm)", cfg.Template.Path))
+			}
+		}
+
+		// two queries or targets writing from the same cell would overwrite each other
+		starts := map[string]bool{}
+		for _, qcfg := range QueryConfigs(cfg) {
+			if qcfg.Template.Sheet == "" {
+				problems = append(problems, errors.New("template sheet must be set"))
+				continue
+			}
+			start := fmt.Sprintf("%s!R%dC%d", qcfg.Template.Sheet, qcfg.Template.Row, qcfg.Template.Col)
+			if starts[start] {
+				problems = append(problems, fmt.Errorf("more than one query writes to sheet %s from row %d, col %d", qcfg.Template.Sheet, qcfg.Template.Row, qcfg.Template.Col))
+			}
+			starts[start] = true
+			if qcfg.Template.Row < 1 {
+				problems = append(problems, fmt.Errorf("template start-row must be at least 1, got %d", qcfg.Template.Row))
+			}
+			if qcfg.Template.Col < 1 {
+				problems = append(problems, fmt.Errorf("template start-col must be at least 1, got %d", qcfg.Template.Col))
+			}
+		}
+	}
+
+	return errors.Join(problems...)
+}
+
+func QueryConfigs(
+	cfg Config,
+) []Config {
+	queries := cfg.Input.Queries
+	if len(queries) == 0 {
+		queries = []Query{{Query: cfg.Input.Query}}
+	}
+
+	// the single query can also fill several sheets, each from its own start cell
+	if len(cfg.Input.Queries) == 0 && len(cfg.Template.Targets) > 0 {
+		queries = []Query{}
+		for _, target := range cfg.Template.Targets {
+			queries = append(queries, Query{Query: cfg.Input.Query, Sheet: target.Sheet, Row: target.Row, Col: target.Col})
+		}
+	}
+
+	res := []Config{}
+	for i, query := range queries {
+		qcfg := cfg
+		qcfg.Input.Query = query.Query
+		if query.Sheet != "" {
+			qcfg.Template.Sheet = query.Sheet
+		}
+		if query.Row != 0 {
+			qcfg.Template.Row = query.Row
+		}
+		if query.Col != 0 {
+			qcfg.Template.Col = query.Col
+		}
+
+		// variables without a sheet belong to the template sheet
+		inSheet := func(sheet string) bool {
+			if sheet == "" {
+				sheet = cfg.Template.Sheet
+			}
+			return sheet == qcfg.Template.Sheet
+		}
+
+		qcfg.Output.Variables = []Variable{}
+		for _, variable := range cfg.Output.Variables {
+			if inSheet(variable.Sheet) {
+				qcfg.Output.Variables = append(qcfg.Output.Variables, variable)
+			}
+		}
+
+		qcfg.Output.Comments = []Comment{}
+		for _, comment := range cfg.Output.Comments {
+			if inSheet(comment.Sheet) {
+				qcfg.Output.Comments = append(qcfg.Output.Comments, comment)
+			}
+		}
+
+		// totalizations without a query belong to the first one
+		qcfg.Output.Totalizations = []Totalization{}
+		for _, tot := range cfg.Output.Totalizations {
+			if (tot.Query == "" && i == 0) || (tot.Query != "" && tot.Query == query.Name) {
+				qcfg.Output.Totalizations = append(qcfg.Output.Totalizations, tot)
+			}
+		}
+
+		res = append(res, qcfg)
+	}
+
+	return res
+}
+
+func DriverName(
+	typ string,
+) (string, error) {
+	switch typ {
+	case "", "sqlite", "sqlite3":
+		return "sqlite3", nil
+	case "postgres", "postgresql":
+		return "postgres", nil
+	case "mysql", "mariadb":
+		return "mysql", nil
+	case "sqlserver", "mssql":
+		return "sqlserver", nil
+	case "csv", "ndjson":
+		// loaded into an in-memory sqlite3 database
+		return "sqlite3", nil
+	default:
+		return "", fmt.Errorf("unsupported input type: %s", typ)
+	}
+}
+
+// connect opens and pings the database, replaced in the tests to check the driver
+var connect = sqlx.Connect
+
+// the returned function closes the connection and removes the temp file of
+// a gzip-compressed sqlite3 source
+func OpenDb(
+	typ string,
+	source Source,
+) (*sqlx.DB, func(), error) {
+	driver, err := DriverName(typ)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if typ == "csv" || typ == "ndjson" {
+		db, err := LoadFileSource(typ, source)
+		if err != nil {
+			return nil, nil, err
+		}
+		return db, func() { db.Close() }, nil
+	}
+
+	temp := ""
+	if driver == "sqlite3" {
+		name, params, found := strings.Cut(source.Name, "?")
+		if strings.HasSuffix(name, ".gz") {
+			temp, err = Gunzip(name)
+			if err != nil {
+				return nil, nil, err
+			}
+			source.Name = temp
+			if found {
+				source.Name += "?" + params
+			}
+		}
+	}
+
+	dsn := SourceDsn(driver, source)
+	var db *sqlx.DB
+	if len(source.Attach) > 0 {
+		db, err = ConnectAttached(dsn, source.Attach)
+	} else {
+		db, err = connect(driver, dsn)
+	}
+	if err != nil {
+		if temp != "" {
+			os.Remove(temp)
+		}
+		return nil, nil, err
+	}
+
+	if source.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(source.MaxOpenConns)
+	}
+	if source.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(source.MaxIdleConns)
+	}
+
+	return db, func() {
+		db.Close()
+		if temp != "" {
+			os.Remove(temp)
+		}
+	}, nil
+}
+
+// AttachConnector opens sqlite3 connections attaching the databases to each
+// one, as every connection of the pool has its own list of attached databases
+type AttachConnector struct {
+	driver *sqlite3.SQLiteDriver
+	dsn    string
+}
+
+func (c AttachConnector) Connect(
+	ctx context.Context,
+) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c AttachConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// ConnectAttached opens and pings a sqlite3 database with the attached ones
+func ConnectAttached(
+	dsn string,
+	attach []Attach,
+) (*sqlx.DB, error) {
+	conn := AttachConnector{
+		driver: &sqlite3.SQLiteDriver{
+			ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+				for _, a := range attach {
+					_, err := conn.Exec(fmt.Sprintf(`ATTACH DATABASE ? AS "%s"`, a.Alias), []driver.Value{a.Path})
+					if err != nil {
+						return fmt.Errorf("attaching %s as %s: %w", a.Path, a.Alias, err)
+					}
+				}
+				return nil
+			},
+		},
+		dsn: dsn,
+	}
+
+	db := sqlx.NewDb(sql.OpenDB(conn), "sqlite3")
+	err := db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+const fileSourceTable = "data"
+
+// LoadFileSource loads a csv file, with a header line, or a file with a json
+// object per line into the data table of an in-memory sqlite3 database, so it
+// can be queried and partitioned like any other source
+func LoadFileSource(
+	typ string,
+	source Source,
+) (*sqlx.DB, error) {
+	file, err := os.Open(source.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var names []string
+	var records [][]interface{}
+	if typ == "csv" {
+		names, records, err = ReadCsvSource(file, source.Options["delimiter"])
+	} else {
+		names, records, err = ReadNdjsonSource(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source.Name, err)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("%s: no columns found", source.Name)
+	}
+
+	db, err := LoadTable(names, records)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source.Name, err)
+	}
+
+	slog.Debug("loaded file source", "source", source.Name, "columns", len(names), "rows", len(records))
+	return db, nil
+}
+
+// LoadTable creates the data table of an in-memory sqlite3 database with the
+// records, the shorter ones padded with NULLs
+func LoadTable(
+	names []string,
+	records [][]interface{},
+) (*sqlx.DB, error) {
+	db, err := sqlx.Connect("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	// every connection would get its own empty in-memory database
+	db.SetMaxOpenConns(1)
+
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+	}
+
+	_, err = db.Exec(fmt.Sprintf("CREATE TABLE %s (%s)", fileSourceTable, strings.Join(quoted, ", ")))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (%s)",
+		fileSourceTable,
+		strings.Join(quoted, ", "),
+		strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", "),
+	))
+	if err == nil {
+		for _, record := range records {
+			args := make([]interface{}, len(names))
+			copy(args, record)
+			if _, err = stmt.Exec(args...); err != nil {
+				break
+			}
+		}
+		stmt.Close()
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// PivotRows reads all the rows into a matrix with a row per distinct row key
+// and a column per distinct column key, in the order they first come, holding
+// the values, summed when a pair repeats; the matrix is queried back from an
+// in-memory table, so it's written like any query result
+func PivotRows(
+	cfg Config,
+	rows *sqlx.Rows,
+) (*sqlx.Rows, func(), error) {
+	pivot := cfg.Output.Pivot
+
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	index := func(name string) (int, error) {
+		for i, col := range names {
+			if col == name {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("pivot column %s not found, available columns: %s", name, strings.Join(names, ", "))
+	}
+	rowIdx, err := index(pivot.Row)
+	if err != nil {
+		return nil, nil, err
+	}
+	colIdx, err := index(pivot.Col)
+	if err != nil {
+		return nil, nil, err
+	}
+	valueIdx, err := index(pivot.Value)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	layout := cfg.Output.TimeFormat
+	if layout == "" {
+		layout = "2006-01-02"
+	}
+	key := func(value interface{}) string {
+		if t, ok := value.(time.Time); ok {
+			return t.Format(layout)
+		}
+		return fmt.Sprint(value)
+	}
+
+	records := [][]interface{}{}
+	byRow := map[string]int{}
+	colKeys := []string{}
+	byCol := map[string]int{}
+	for rows.Next() {
+		cols, err := rows.SliceScan()
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := range cols {
+			cols[i] = NormalizeValue(DriverValue(cols[i]), types[i].DatabaseTypeName())
+		}
+
+		rk, ck := key(cols[rowIdx]), key(cols[colIdx])
+		c, ok := byCol[ck]
+		if !ok {
+			c = len(colKeys) + 1
+			byCol[ck] = c
+			colKeys = append(colKeys, ck)
+		}
+		r, ok := byRow[rk]
+		if !ok {
+			r = len(records)
+			byRow[rk] = r
+			records = append(records, []interface{}{cols[rowIdx]})
+		}
+		for len(records[r]) <= c {
+			records[r] = append(records[r], nil)
+		}
+		records[r][c] = PivotSum(records[r][c], cols[valueIdx])
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	db, err := LoadTable(UniqueNames(append([]string{pivot.Row}, colKeys...)), records)
+	if err != nil {
+		return nil, nil, fmt.Errorf("pivot: %w", err)
+	}
+	res, err := db.Queryx("SELECT * FROM " + fileSourceTable + " ORDER BY rowid")
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	return res, func() {
+		res.Close()
+		db.Close()
+	}, nil
+}
+
+// the pivot column keys may repeat the row column or differ from each other
+// only in case, which sqlite takes as the same column, so they get a suffix
+// like the split sheets
+func UniqueNames(
+	names []string,
+) []string {
+	res := make([]string, len(names))
+	taken := map[string]bool{}
+	for i, name := range names {
+		unique := name
+		for n := 2; taken[strings.ToLower(unique)]; n++ {
+			unique = fmt.Sprintf("%s_%d", name, n)
+		}
+		taken[strings.ToLower(unique)] = true
+		res[i] = unique
+	}
+
+	return res
+}
+
+// the repeated numbers are added up, while other values just replace the last one
+func PivotSum(
+	prev interface{},
+	value interface{},
+) interface{} {
+	switch p := prev.(type) {
+	case int64:
+		switch v := value.(type) {
+		case int64:
+			return p + v
+		case float64:
+			return float64(p) + v
+		}
+	case float64:
+		switch v := value.(type) {
+		case int64:
+			return p + float64(v)
+		case float64:
+			return p + v
+		}
+	}
+	if value == nil {
+		return prev
+	}
+
+	return value
+}
+
+// the fields are stored as integers or floats when they parse as such, and
+// the empty ones as NULLs
+func ReadCsvSource(
+	r io.Reader,
+	delimiter string,
+) ([]string, [][]interface{}, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	if delimiter != "" {
+		cr.Comma, _ = utf8.DecodeRuneInString(delimiter)
+	}
+
+	names, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records := [][]interface{}{}
+	for {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		record := make([]interface{}, min(len(fields), len(names)))
+		for i := range record {
+			record[i] = FieldValue(fields[i])
+		}
+		records = append(records, record)
+	}
+
+	return names, records, nil
+}
+
+func FieldValue(
+	field string,
+) interface{} {
+	if field == "" {
+		return nil
+	}
+	if num, err := strconv.ParseInt(field, 10, 64); err == nil {
+		return num
+	}
+	if num, err := strconv.ParseFloat(field, 64); err == nil {
+		return num
+	}
+
+	return field
+}
+
+// the columns are the keys of all the objects, in the order they first appear;
+// nested objects and arrays are kept as json text
+func ReadNdjsonSource(
+	r io.Reader,
+) ([]string, [][]interface{}, error) {
+	names := []string{}
+	index := map[string]int{}
+	records := [][]interface{}{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		dec.UseNumber()
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+			return nil, nil, fmt.Errorf("line %d: not a json object", line)
+		}
+
+		record := make([]interface{}, len(names))
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			key := tok.(string)
+
+			var value interface{}
+			err = dec.Decode(&value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: %w", line, err)
+			}
+
+			i, ok := index[key]
+			if !ok {
+				i = len(names)
+				index[key] = i
+				names = append(names, key)
+				record = append(record, nil)
+			}
+
+			switch v := value.(type) {
+			case json.Number:
+				record[i] = FieldValue(v.String())
+			case map[string]interface{}, []interface{}:
+				text, _ := json.Marshal(v)
+				record[i] = string(text)
+			default:
+				record[i] = v
+			}
+		}
+
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return names, records, nil
+}
+
+func Gunzip(
+	path string,
+) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	defer zr.Close()
+
+	dst, err := os.CreateTemp("", "sql2excel-*.db")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err = io.Copy(dst, zr); err == nil {
+		err = dst.Close()
+	} else {
+		dst.Close()
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+
+	return dst.Name(), nil
+}
+
+// the options are appended as query parameters (e.g. sqlite3 _busy_timeout),
+// or as key=value pairs to the postgres and sqlserver connection strings not
+// in url form
+func SourceDsn(
+	driver string,
+	source Source,
+) string {
+	if len(source.Options) == 0 {
+		return source.Name
+	}
+
+	keys := make([]string, 0, len(source.Options))
+	for key := range source.Options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if driver == "postgres" && !strings.Contains(source.Name, "://") {
+		dsn := source.Name
+		for _, key := range keys {
+			dsn += fmt.Sprintf(" %s='%s'", key, strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(source.Options[key]))
+		}
+		return dsn
+	}
+	// the ado dsns of sqlserver are key=value pairs separated by semicolons
+	if driver == "sqlserver" && !strings.Contains(source.Name, "://") {
+		dsn := strings.TrimSuffix(source.Name, ";")
+		for _, key := range keys {
+			dsn += fmt.Sprintf(";%s=%s", key, source.Options[key])
+		}
+		return dsn
+	}
+
+	params := url.Values{}
+	for _, key := range keys {
+		params.Set(key, source.Options[key])
+	}
+
+	sep := "?"
+	if strings.Contains(source.Name, "?") {
+		sep = "&"
+	}
+
+	return source.Name + sep + params.Encode()
+}
+
+// DriverValue resolves the values some drivers return wrapped, like the typed
+// NULLs and raw bytes, into plain ones, a NULL becoming nil
+func DriverValue(
+	value interface{},
+) interface{} {
+	switch v := value.(type) {
+	case sql.RawBytes:
+		return append([]byte{}, v...)
+	case driver.Valuer:
+		plain, err := v.Value()
+		if err != nil {
+			return value
+		}
+		return plain
+	}
+
+	return value
+}
+
+// NormalizeValue converts the driver values to the same set whatever the
+// database: nil, string, int64, float64, bool and time.Time, the bytes of the
+// text protocols converted like the strings by column type (the blob columns
+// are handled before), so the same data is written the same way from every driver
+func NormalizeValue(
+	value interface{},
+	dbType string,
+) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return ConvertValue(string(v), dbType)
+	case string:
+		return ConvertValue(v, dbType)
+	case int:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint:
+		return NormalizeValue(uint64(v), dbType)
+	case uint8:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		if v > math.MaxInt64 {
+			return float64(v)
+		}
+		return int64(v)
+	case float32:
+		// through its shortest text, so 0.1 doesn't become 0.10000000149011612
+		num, _ := strconv.ParseFloat(strconv.FormatFloat(float64(v), 'g', -1, 32), 64)
+		return num
+	}
+
+	return value
+}
+
+// the drivers using the text protocol (e.g. mysql, sqlserver, postgres) return
+// the numbers, dates and text columns as text, converted here by column type
+func ConvertValue(
+	str string,
+	dbType string,
+) interface{} {
+	typ := strings.ToUpper(dbType)
+	typ = strings.TrimPrefix(typ, "UNSIGNED ")
+	switch typ {
+	case "DECIMAL", "NUMERIC", "MONEY", "SMALLMONEY", "FLOAT", "FLOAT4", "FLOAT8", "DOUBLE", "REAL":
+		if num, err := strconv.ParseFloat(str, 64); err == nil {
+			return num
+		}
+	case "INT", "INTEGER", "TINYINT", "SMALLINT", "MEDIUMINT", "BIGINT", "INT2", "INT4", "INT8":
+		if num, err := strconv.ParseInt(str, 10, 64); err == nil {
+			return num
+		}
+	case "DATE", "DATETIME", "TIMESTAMP":
+		for _, layout := range []string{"2006-01-02 15:04:05.999999999", "2006-01-02"} {
+			if t, err := time.Parse(layout, str); err == nil {
+				return t
+			}
+		}
+	}
+
+	return str
+}
+
+// binary values are written as text or their length in bytes, or left blank
+func BlobValue(
+	value interface{},
+	blob string,
+) interface{} {
+	b, ok := value.([]byte)
+	if !ok {
+		return value
+	}
+
+	switch blob {
+	case "base64":
+		return base64.StdEncoding.EncodeToString(b)
+	case "hex":
+		return hex.EncodeToString(b)
+	case "length":
+		return len(b)
+	default:
+		return nil
+	}
+}
+
+// the bounds, value and dimensions of the partition, with the bounds of the named
+// date dimensions as {part.name.beg}; other tokens are left as they are
+var partTokens = regexp.MustCompile(`\{part\.[A-Za-z0-9_]+(\.(beg|end))?\}`)
+
+func BindQuery(
+	bindType int,
+	query string,
+	values map[string]string,
+) (string, []interface{}) {
+	args := []interface{}{}
+
+	query = partTokens.ReplaceAllStringFunc(query, func(token string) string {
+		value, ok := values[token]
+		if !ok {
+			return token
+		}
+		args = append(args, value)
+		return "?"
+	})
+
+	return sqlx.Rebind(bindType, query), args
+}
+
+func ColumnNames(
+	cfg Config,
+	rows *sqlx.Rows,
+) ([]string, error) {
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range names {
+		if i < len(cfg.Output.HeaderNames) && cfg.Output.HeaderNames[i] != "" {
+			names[i] = cfg.Output.HeaderNames[i]
+		}
+	}
+
+	if cfg.Output.SourceColumn != "" {
+		names = append([]string{cfg.Output.SourceColumn}, names...)
+	}
+
+	return names, nil
+}
+
+// the number of written columns, counting the source column
+func RowWidth(
+	cfg Config,
+	types []*sql.ColumnType,
+) int {
+	if cfg.Output.SourceColumn != "" {
+		return len(types) + 1
+	}
+
+	return len(types)
+}
+
+func WriteHeader(
+	cfg Config,
+	tpl *excelize.File,
+	sheet string,
+	rows *sqlx.Rows,
+) error {
+	names, err := ColumnNames(cfg, rows)
+	if err != nil {
+		return err
+	}
+
+	header := make([]interface{}, len(names))
+	for i, name := range names {
+		header[i] = name
+	}
+
+	if cfg.Template.Row <= 1 {
+		return errors.New("the header requires start-row to be greater than 1")
+	}
+
+	axis, err := excelize.CoordinatesToCellName(cfg.Template.Col, cfg.Template.Row-1)
+	if err != nil {
+		return err
+	}
+
+	return tpl.SetSheetRow(sheet, axis, &header)
+}
+
+const progressStep = 10000
+
+func ReportProgress(
+	cfg Config,
+	count int,
+) {
+	if cfg.Progress && count%progressStep == 0 {
+		slog.Info("progress", "rows", count)
+	}
+}
+
+// the rows past the limit are left unread, and closing them discards the rest
+func LimitReached(
+	cfg Config,
+	count int,
+) bool {
+	return cfg.Output.Limit > 0 && count >= cfg.Output.Limit
+}
+
+func ScanRow(
+	cfg Config,
+	state *PartitionState,
+	rows *sqlx.Rows,
+	types []*sql.ColumnType,
+) ([]interface{}, error) {
+	cols, err := rows.SliceScan()
+	if err != nil {
+		return nil, err
+	}
+
+	lead := RowWidth(cfg, types) - len(types)
+	kinds := ColumnKinds(cfg, RowWidth(cfg, types))
+
+	for i, col := range cols {
+		col = DriverValue(col)
+		// NULLs are written as the placeholder text whatever the column type, or left blank
+		if col == nil {
+			if cfg.Output.NullText != "" {
+				cols[i] = cfg.Output.NullText
+			}
+			continue
+		}
+		if blob := kinds[lead+i].Blob; blob != "" {
+			cols[i] = BlobValue(col, blob)
+			continue
+		}
+		cols[i] = NormalizeValue(col, types[i].DatabaseTypeName())
+	}
+
+	if cfg.Output.SourceColumn != "" {
+		cols = append([]interface{}{state.Source}, cols...)
+	}
+
+	if state.Capture != nil {
+		state.Capture.Rows = append(state.Capture.Rows, cols)
+	}
+
+	return cols, nil
+}
+
+// the columns are coerced to their types like the xlsx cells, the dates
+// formatted with their column layout
+func CsvRecord(
+	cols []interface{},
+	kinds []Column,
+) []string {
+	record := make([]string, len(cols))
+	for i, col := range cols {
+		var kind Column
+		if i < len(kinds) {
+			kind = kinds[i]
+		}
+		switch value := CoerceValue(col, kind).(type) {
+		case nil:
+			record[i] = ""
+		case time.Time:
+			layout := kind.Layout
+			if layout == "" {
+				layout = time.RFC3339
+			}
+			record[i] = value.Format(layout)
+		default:
+			record[i] = fmt.Sprint(value)
+		}
+	}
+
+	return record
+}
+
+// CsvCopy tells whether the xlsx outputs get a csv copy each
+func CsvCopy(
+	cfg Config,
+) bool {
+	return cfg.Output.Type != "csv" && slices.Contains(cfg.Output.Formats, "csv")
+}
+
+// WriteCsvCopy writes the rows captured while filling the xlsx output
+func WriteCsvCopy(
+	cfg Config,
+	dst string,
+	capture *Capture,
+) error {
+	file, err := os.Create(PartialPath(dst))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	if cfg.Output.Header {
+		err = w.Write(capture.Names)
+		if err != nil {
+			return err
+		}
+	}
+	kinds := ColumnKinds(cfg, len(capture.Names))
+	for _, cols := range capture.Rows {
+		err = w.Write(CsvRecord(cols, kinds))
+		if err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+	err = w.Error()
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		os.Remove(PartialPath(dst))
+		return err
+	}
+
+	return os.Rename(PartialPath(dst), dst)
+}
+
+func WriteCsv(
+	cfg Config,
+	state *PartitionState,
+	dst string,
+	rows *sqlx.Rows,
+) (int, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return 0, err
+	}
+
+	var out io.Writer = os.Stdout
+	var file *os.File
+	if dst != "-" {
+		file, err = os.Create(dst)
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	w := csv.NewWriter(out)
+
+	if cfg.Output.Header {
+		names, err := ColumnNames(cfg, rows)
+		if err != nil {
+			return 0, err
+		}
+		err = w.Write(names)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	kinds := ColumnKinds(cfg, RowWidth(cfg, types))
+	count := 0
+	for !LimitReached(cfg, count) && rows.Next() {
+		cols, err := ScanRow(cfg, state, rows, types)
+		if err != nil {
+			return 0, err
+		}
+
+		err = w.Write(CsvRecord(cols, kinds))
+		if err != nil {
+			return 0, err
+		}
+
+		count++
+		slog.Debug("wrote row", "file", dst, "row", count)
+		ReportProgress(cfg, count)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	w.Flush()
+	err = w.Error()
+	if err != nil {
+		return 0, err
+	}
+
+	if cfg.Output.SkipEmpty && count == 0 {
+		slog.Info("skipping empty partition", "file", dst)
+		if file == nil {
+			return 0, nil
+		}
+		file.Close()
+		return 0, os.Remove(dst)
+	}
+
+	if file == nil {
+		return count, nil
+	}
+	return count, file.Close()
+}
+
+func LoadTemplate(
+	path string,
+) (*excelize.File, error) {
+	tpl, err := excelize.OpenFile(path)
+	if err != nil {
+		return tpl, err
+	}
+
+	defer func() {
+		_ = tpl.Close()
+	}()
+
+	return tpl, nil
+}
+
+// the remote templates are downloaded once, and not for every partition
+var remoteTemplates sync.Map
+
+func TemplateData(
+	cfg Config,
+) ([]byte, error) {
+	path := cfg.Template.Path
+	if path == "" {
+		return defaultTemplate, nil
+	}
+
+	if data, ok := remoteTemplates.Load(path); ok {
+		return data.([]byte), nil
+	}
+
+	data, err := StorageFor(path).Read(path)
+	if err == nil && IsRemote(path) {
+		remoteTemplates.Store(path, data)
+	}
+
+	return data, err
+}
+
+// Storage reads and writes whole files, selected by the path scheme
+type Storage interface {
+	Read(path string) ([]byte, error)
+	Write(path string, data []byte) error
+}
+
+type LocalStorage struct{}
+
+type HttpStorage struct{}
+
+// S3Storage signs the requests with the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and optional AWS_SESSION_TOKEN variables, in the AWS_REGION; AWS_ENDPOINT_URL
+// points to a compatible service (e.g. MinIO), addressed in path style
+type S3Storage struct{}
+
+func IsRemote(
+	path string,
+) bool {
+	_, local := StorageFor(path).(LocalStorage)
+	return !local
+}
+
+func StorageFor(
+	path string,
+) Storage {
+	switch {
+	case strings.HasPrefix(path, "s3://"):
+		return S3Storage{}
+	case strings.HasPrefix(path, "http://"), strings.HasPrefix(path, "https://"):
+		return HttpStorage{}
+	default:
+		return LocalStorage{}
+	}
+}
+
+// joins a file name to a remote dir, as filepath.Join would squash the scheme slashes
+func RemotePath(
+	dir string,
+	name string,
+) string {
+	return strings.TrimSuffix(dir, "/") + "/" + filepath.ToSlash(name)
+}
+
+func (LocalStorage) Read(
+	path string,
+) ([]byte, error) {
+	return ioutil.ReadFile(path)
+}
+
+func (LocalStorage) Write(
+	path string,
+	data []byte,
+) error {
+	return os.WriteFile(path, data, 0644)
+}
+
+func (HttpStorage) Read(
+	path string,
+) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return DoRequest(req)
+}
+
+func (HttpStorage) Write(
+	path string,
+	data []byte,
+) error {
+	req, err := http.NewRequest(http.MethodPut, path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	_, err = DoRequest(req)
+	return err
+}
+
+func (S3Storage) Read(
+	path string,
+) ([]byte, error) {
+	req, err := S3Request(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return DoRequest(req)
+}
+
+func (S3Storage) Write(
+	path string,
+	data []byte,
+) error {
+	req, err := S3Request(http.MethodPut, path, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = DoRequest(req)
+	return err
+}
+
+func DoRequest(
+	req *http.Request,
+) ([]byte, error) {
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Redacted(), res.Status)
+	}
+
+	return body, nil
+}
+
+// S3Request builds a request for the s3://bucket/key path, signed with AWS
+// signature version 4
+func S3Request(
+	method string,
+	path string,
+	data []byte,
+) (*http.Request, error) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(path, "s3://"), "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("invalid s3 path: %s (s3://bucket/key)", path)
+	}
+
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("s3 paths require the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY variables")
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	encoded := "/" + S3Escape(key)
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = "https://" + bucket + ".s3." + region + ".amazonaws.com"
+	} else {
+		endpoint = strings.TrimSuffix(endpoint, "/")
+		encoded = "/" + S3Escape(bucket) + encoded
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.RawPath = u.EscapedPath() + encoded
+	u.Path, err = url.PathUnescape(u.RawPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	stamp := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	hash := sha256.Sum256(data)
+	payload := hex.EncodeToString(hash[:])
+
+	headers := map[string]string{
+		"host":                 u.Host,
+		"x-amz-content-sha256": payload,
+		"x-amz-date":           stamp,
+	}
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		headers["x-amz-security-token"] = token
+	}
+
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+		if name != "host" {
+			req.Header.Set(name, headers[name])
+		}
+	}
+	sort.Strings(names)
+
+	canonical := []string{method, u.RawPath, ""}
+	for _, name := range names {
+		canonical = append(canonical, name+":"+headers[name])
+	}
+	signed := strings.Join(names, ";")
+	canonical = append(canonical, "", signed, payload)
+
+	scope := day + "/" + region + "/s3/aws4_request"
+	hash = sha256.Sum256([]byte(strings.Join(canonical, "\n")))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	signingKey := []byte("AWS4" + secretKey)
+	for _, part := range []string{day, region, "s3", "aws4_request", toSign} {
+		mac := hmac.New(sha256.New, signingKey)
+		mac.Write([]byte(part))
+		signingKey = mac.Sum(nil)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signed, hex.EncodeToString(signingKey),
+	))
+
+	return req, nil
+}
+
+// escapes everything but the unreserved characters and the slashes, as the
+// signature requires
+func S3Escape(
+	key string,
+) string {
+	var sb strings.Builder
+	for _, b := range []byte(key) {
+		switch {
+		case b >= 'A' && b <= 'Z', b >= 'a' && b <= 'z', b >= '0' && b <= '9', strings.IndexByte("-._~/", b) >= 0:
+			sb.WriteByte(b)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+
+	return sb.String()
+}
+
+// UploadOutputs copies the files written to the local staging dir to the
+// remote output dir, but the skipped one, returning the remote path of each local one
+func UploadOutputs(
+	local string,
+	remote string,
+	skip string,
+) (map[string]string, error) {
+	res := map[string]string{}
+
+	err := filepath.WalkDir(local, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || path == skip {
+			return err
+		}
+
+		dst, err := UploadFile(local, path, remote)
+		if err != nil {
+			return err
+		}
+		res[path] = dst
+
+		return nil
+	})
+
+	return res, err
+}
+
+// UploadFile copies a file of the local staging dir to the same relative path
+// of the remote output dir
+func UploadFile(
+	local string,
+	path string,
+	remote string,
+) (string, error) {
+	rel, err := filepath.Rel(local, path)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	dst := RemotePath(remote, rel)
+	err = StorageFor(dst).Write(dst, data)
+	if err != nil {
+		return "", err
+	}
+	slog.Info("uploaded file", "file", dst)
+
+	return dst, nil
+}
+
+// ResolveNamedRange takes the template sheet and start cell from a defined name
+// of the template, e.g. example!$B$10:$E$40; a range spanning several rows also
+// limits the rows written
+func (cfg *Config) ResolveNamedRange() error {
+	data, err := TemplateData(*cfg)
+	if err != nil {
+		return err
+	}
+
+	tpl, err := excelize.OpenReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer tpl.Close()
+
+	ref := ""
+	for _, name := range tpl.GetDefinedName() {
+		if !strings.EqualFold(name.Name, cfg.Template.NamedRange) {
+			continue
+		}
+		if name.Scope == "Workbook" || cfg.Template.Sheet == "" || name.Scope == cfg.Template.Sheet {
+			ref = strings.TrimPrefix(name.RefersTo, "=")
+			break
+		}
+	}
+	if ref == "" {
+		return fmt.Errorf("template named-range %s not found", cfg.Template.NamedRange)
+	}
+
+	i := strings.LastIndex(ref, "!")
+	if i == -1 {
+		return fmt.Errorf("template named-range %s doesn't refer to a sheet range: %s", cfg.Template.NamedRange, ref)
+	}
+	sheet := ref[:i]
+	if strings.HasPrefix(sheet, "'") {
+		sheet = strings.ReplaceAll(strings.Trim(sheet, "'"), "''", "'")
+	}
+
+	first, last, _ := strings.Cut(strings.ReplaceAll(ref[i+1:], "$", ""), ":")
+	col, row, err := excelize.CellNameToCoordinates(first)
+	if err != nil {
+		return fmt.Errorf("template named-range %s: %w", cfg.Template.NamedRange, err)
+	}
+
+	cfg.Template.Sheet = sheet
+	cfg.Template.Row = row
+	cfg.Template.Col = col
+
+	if last != "" {
+		_, lastRow, err := excelize.CellNameToCoordinates(last)
+		if err != nil {
+			return fmt.Errorf("template named-range %s: %w", cfg.Template.NamedRange, err)
+		}
+		rows := lastRow - row + 1
+		if rows > 1 && (cfg.Output.Limit == 0 || cfg.Output.Limit > rows) {
+			cfg.Output.Limit = rows
+		}
+	}
+
+	return nil
+}
+
+func CheckTemplate(
+	cfg Config,
+) error {
+	data, err := TemplateData(cfg)
+	if err != nil {
+		return err
+	}
+
+	tpl, err := excelize.OpenReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer tpl.Close()
+
+	path := cfg.Template.Path
+	if path == "" {
+		path = "the default template"
+	}
+
+	for _, qcfg := range QueryConfigs(cfg) {
+		if tpl.GetSheetIndex(qcfg.Template.Sheet) == -1 {
+			return fmt.Errorf(
+				"template sheet %s not found in %s, available sheets: %s",
+				qcfg.Template.Sheet,
+				path,
+				strings.Join(tpl.GetSheetList(), ", "),
+			)
+		}
+	}
+
+	return nil
+}
+
+var relativePattern = regexp.MustCompile(`^([+-]\d+)([dwMy])$`)
+
+// resolves relative dates (today, yesterday, -30d, start-of-month...)
+// against now, returning the value unchanged when it isn't relative; the
+// weeks start on the partition week-start, or on sunday
+func RelativeDate(
+	value string,
+	now time.Time,
+	weekStart string,
+) (string, error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	var res time.Time
+	switch strings.TrimSpace(value) {
+	case "today":
+		res = today
+	case "yesterday":
+		res = today.AddDate(0, 0, -1)
+	case "tomorrow":
+		res = today.AddDate(0, 0, 1)
+	case "start-of-week":
+		if weekStart == "" {
+			weekStart = "sunday"
+		}
+		var err error
+		res, err = AlignWeek(today, weekStart)
+		if err != nil {
+			return value, err
+		}
+	case "start-of-month":
+		res = today.AddDate(0, 0, 1-today.Day())
+	case "end-of-month":
+		res = today.AddDate(0, 1, -today.Day())
+	case "start-of-quarter":
+		res = today.AddDate(0, -(int(today.Month())-1)%3, 1-today.Day())
+	case "start-of-year":
+		res = today.AddDate(0, 1-int(today.Month()), 1-today.Day())
+	case "end-of-year":
+		res = time.Date(today.Year(), time.December, 31, 0, 0, 0, 0, today.Location())
+	default:
+		match := relativePattern.FindStringSubmatch(strings.TrimSpace(value))
+		if match == nil {
+			return value, nil
+		}
+		n, _ := strconv.Atoi(match[1])
+		switch match[2] {
+		case "d":
+			res = today.AddDate(0, 0, n)
+		case "w":
+			res = today.AddDate(0, 0, 7*n)
+		case "M":
+			res = today.AddDate(0, n, 0)
+		case "y":
+			res = today.AddDate(n, 0, 0)
+		}
+	}
+
+	return res.Format("2006-01-02"), nil
+}
+
+func ParseBoundary(
+	value string,
+	defaultTime string,
+	loc *time.Location,
+	weekStart string,
+) (time.Time, error) {
+	value, err := RelativeDate(value, time.Now().In(loc), weekStart)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	res, err := time.ParseInLocation("2006-01-02T15:04:05", value, loc)
+	if err == nil {
+		return res, nil
+	}
+
+	return time.ParseInLocation("2006-01-02T15:04:05", value+defaultTime, loc)
+}
+
+var intervalPattern = regexp.MustCompile(`^(\d+)([a-zA-Z])$`)
+
+func ParseInterval(
+	interval string,
+) (func(time.Time) time.Time, error) {
+	match := intervalPattern.FindStringSubmatch(strings.TrimSpace(interval))
+	if match == nil {
+		return nil, errors.New("invalid partition interval")
+	}
+
+	n, err := strconv.Atoi(match[1])
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 {
+		return nil, errors.New("partition interval must be greater than zero")
+	}
+
+	switch match[2] {
+	case "m":
+		return func(cur time.Time) time.Time { return cur.Add(time.Duration(n) * time.Minute) }, nil
+	case "h":
+		return func(cur time.Time) time.Time { return cur.Add(time.Duration(n) * time.Hour) }, nil
+	case "d":
+		return func(cur time.Time) time.Time { return cur.AddDate(0, 0, n) }, nil
+	case "w":
+		return func(cur time.Time) time.Time { return cur.AddDate(0, 0, 7*n) }, nil
+	case "M":
+		return func(cur time.Time) time.Time { return cur.AddDate(0, n, 0) }, nil
+	case "y":
+		return func(cur time.Time) time.Time { return cur.AddDate(n, 0, 0) }, nil
+	default:
+		return nil, errors.New("unsupported partition interval unit")
+	}
+}
+
+func AlignWeek(
+	begin time.Time,
+	weekStart string,
+) (time.Time, error) {
+	if weekStart == "" {
+		return begin, nil
+	}
+
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(day.String(), weekStart) {
+			diff := (int(begin.Weekday()) - int(day) + 7) % 7
+			return begin.AddDate(0, 0, -diff), nil
+		}
+	}
+
+	return begin, errors.New("unsupported week start day")
+}
+
+func CreateColumnPartitions(
+	part Partition,
+	db *sqlx.DB,
+) ([]Part, error) {
+	res := []Part{}
+
+	values := part.Values
+	if len(values) == 0 {
+		if part.Column == "" || part.Table == "" {
+			return res, errors.New("column partitions require either values or column and table")
+		}
+
+		query := fmt.Sprintf("SELECT DISTINCT %s FROM %s ORDER BY %s", part.Column, part.Table, part.Column)
+		if db == nil {
+			fmt.Printf("Would load the partition values with: %s\n", query)
+			return res, nil
+		}
+
+		rows, err := db.Queryx(query)
+		if err != nil {
+			return res, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			cols, err := rows.SliceScan()
+			if err != nil {
+				return res, err
+			}
+			value := DriverValue(cols[0])
+			if value == nil {
+				continue
+			}
+			values = append(values, fmt.Sprint(NormalizeValue(value, "")))
+		}
+		if err = rows.Err(); err != nil {
+			return res, err
+		}
+	}
+
+	for _, value := range values {
+		res = append(res, Part{Value: value})
+	}
+
+	return res, nil
+}
+
+func PartitionRefs(
+	parts []Partition,
+) []*Partition {
+	res := []*Partition{}
+	for i := range parts {
+		res = append(res, &parts[i])
+	}
+	return res
+}
+
+// SourcePartitions combines the partitions of the source dimensions, the first
+// one varying the slowest, or creates those of its single partition; a date
+// dimension following another one only keeps the partitions starting within
+// the window of the previous, e.g. the days of each month
+func SourcePartitions(
+	source Source,
+	db *sqlx.DB,
+) ([]Part, error) {
+	if len(source.Partitions) == 0 {
+		return CreatePartitions(source.Partition, db)
+	}
+
+	res := []Part{{}}
+	for _, dim := range source.Partitions {
+		parts, err := CreatePartitions(dim, db)
+		if err != nil {
+			return nil, fmt.Errorf("partition %s: %w", dim.Name, err)
+		}
+
+		combined := []Part{}
+		for _, prev := range res {
+			for _, part := range parts {
+				if !part.Begin.IsZero() && !prev.Begin.IsZero() &&
+					(part.Begin.Before(prev.Begin) || part.Begin.After(prev.End)) {
+					continue
+				}
+				cur := prev
+				cur.Dims = append(append([]Dim{}, prev.Dims...), Dim{Name: dim.Name, Part: part})
+				if part.Begin.IsZero() {
+					cur.Value = strings.TrimPrefix(prev.Value+"-"+part.Value, "-")
+				} else {
+					cur.Begin, cur.End = part.Begin, part.End
+				}
+				combined = append(combined, cur)
+			}
+		}
+		res = combined
+	}
+
+	return res, nil
+}
+
+// the value of a column dimension, or the begin of a date one
+func DimValue(
+	dim Dim,
+	layout string,
+) string {
+	if dim.Part.Begin.IsZero() {
+		return dim.Part.Value
+	}
+
+	return dim.Part.Begin.Format(layout)
+}
+
+func CreatePartitions(
+	part Partition,
+	db *sqlx.DB,
+) ([]Part, error) {
+	if part.Type == "column" {
+		return CreateColumnPartitions(part, db)
+	}
+
+	res := []Part{}
+
+	loc, err := time.LoadLocation(part.Timezone)
+	if err != nil {
+		return res, err
+	}
+
+	begin, err := ParseBoundary(part.Begin, "T00:00:00", loc, part.WeekStart)
+	if err != nil {
+		return res, err
+	}
+	end, err := ParseBoundary(part.End, "T23:59:59", loc, part.WeekStart)
+	if err != nil {
+		return res, err
+	}
+	var adder func(time.Time) time.Time
+
+	if part.Interval != "" {
+		adder, err = ParseInterval(part.Interval)
+		if err != nil {
+			return res, err
+		}
+	} else {
+		switch part.Type {
+		case "minute":
+			adder = func(cur time.Time) time.Time { return cur.Add(time.Minute) }
+		case "hour", "hourly":
+			adder = func(cur time.Time) time.Time { return cur.Add(time.Hour) }
+		case "day", "daily":
+			adder = func(cur time.Time) time.Time { return cur.AddDate(0, 0, 1) }
+		case "week", "weekly":
+			adder = func(cur time.Time) time.Time { return cur.AddDate(0, 0, 7) }
+			begin, err = AlignWeek(begin, part.WeekStart)
+			if err != nil {
+				return res, err
+			}
+		case "month", "monthly":
+			adder = func(cur time.Time) time.Time { return cur.AddDate(0, 1, 0) }
+		case "quarter", "quarterly":
+			adder = func(cur time.Time) time.Time { return cur.AddDate(0, 3, 0) }
+			begin = begin.AddDate(0, -(int(begin.Month())-1)%3, 1-begin.Day())
+		case "year", "yearly":
+			adder = func(cur time.Time) time.Time { return cur.AddDate(1, 0, 0) }
+		case "fiscal-year":
+			if part.FiscalStart < 1 || part.FiscalStart > 12 {
+				return res, fmt.Errorf("invalid partition fiscal-start: %d (must be a month from 1 to 12)", part.FiscalStart)
+			}
+			adder = func(cur time.Time) time.Time { return cur.AddDate(1, 0, 0) }
+			// back to the start of the fiscal year containing the begin date
+			begin = begin.AddDate(0, -(int(begin.Month())-part.FiscalStart+12)%12, 1-begin.Day())
+		default:
+			return res, errors.New("unsupported partition type")
+		}
+	}
+
+	inclusive := part.EndInclusive == nil || *part.EndInclusive
+
+	for cur := begin; cur.Before(end); cur = adder(cur) {
+		next := adder(cur)
+		if inclusive {
+			// the last instant before the next partition, whatever its granularity
+			next = next.Add(-time.Nanosecond)
+		}
+		res = append(res, Part{Begin: cur, End: next})
+	}
+
+	return res, nil
+}
+
+func UserTokens(
+	cfg Config,
+) []string {
+	keys := make([]string, 0, len(cfg.Variables))
+	for key := range cfg.Variables {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		pairs = append(pairs, "{"+key+"}", cfg.Variables[key])
+	}
+
+	for _, env := range os.Environ() {
+		if name, value, ok := strings.Cut(env, "="); ok {
+			pairs = append(pairs, "{env."+name+"}", value)
+		}
+	}
+
+	return pairs
+}
+
+// {source.name} defaults to the database file name without its extension, or
+// to the database name of a server dsn, never to its user or password as the
+// label ends up in the logs, file names and cells
+func SourceLabel(
+	typ string,
+	source Source,
+) string {
+	if source.Label != "" {
+		return source.Label
+	}
+
+	driver, _ := DriverName(typ)
+	if driver != "sqlite3" {
+		return DsnLabel(driver, source.Name)
+	}
+
+	name, _, _ := strings.Cut(source.Name, "?")
+	name = strings.TrimSuffix(filepath.Base(name), ".gz")
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// the key=value dsn settings naming the database and the host
+var dsnDatabaseKeys = []string{"dbname", "database", "initial catalog"}
+var dsnHostKeys = []string{"host", "server", "data source", "address", "addr"}
+
+// DsnLabel takes the database name of a dsn, or else its host, in the url,
+// key=value and mysql forms
+func DsnLabel(
+	driver string,
+	dsn string,
+) string {
+	var host, dbname string
+	switch {
+	case strings.Contains(dsn, "://"):
+		u, err := url.Parse(dsn)
+		if err == nil {
+			host = u.Hostname()
+			dbname = strings.Trim(u.Path, "/")
+			if db := u.Query().Get("database"); db != "" {
+				dbname = db
+			}
+		}
+	case driver == "mysql":
+		// user:password@protocol(address)/dbname?params
+		rest := dsn
+		if i := strings.LastIndex(rest, "@"); i >= 0 {
+			rest = rest[i+1:]
+		}
+		rest, _, _ = strings.Cut(rest, "?")
+		address, db, _ := strings.Cut(rest, "/")
+		dbname = db
+		if open := strings.Index(address, "("); open >= 0 {
+			address = strings.TrimSuffix(address[open+1:], ")")
+		}
+		host, _, _ = strings.Cut(address, ":")
+	default:
+		// postgres separates the settings with spaces, sqlserver with semicolons
+		settings := map[string]string{}
+		for _, field := range strings.FieldsFunc(dsn, func(r rune) bool { return r == ' ' || r == ';' }) {
+			if key, value, ok := strings.Cut(field, "="); ok {
+				settings[strings.ToLower(strings.TrimSpace(key))] = strings.Trim(value, `'"`)
+			}
+		}
+		for _, key := range dsnDatabaseKeys {
+			if dbname == "" {
+				dbname = settings[key]
+			}
+		}
+		for _, key := range dsnHostKeys {
+			if host == "" {
+				host = settings[key]
+			}
+		}
+	}
+
+	switch {
+	case dbname != "":
+		return dbname
+	case host != "":
+		return host
+	default:
+		return driver
+	}
+}
+
+func PartitionTokens(
+	cfg Config,
+	source string,
+	num int,
+	index int,
+	part Part,
+	begin string,
+	end string,
+) *strings.Replacer {
+	// the calendar tokens are taken from the partition begin
+	quarter, q, year, month, monthName := "", "", "", "", ""
+	if !part.Begin.IsZero() {
+		quarter = fmt.Sprintf("Q%d-%d", (int(part.Begin.Month())-1)/3+1, part.Begin.Year())
+		q = fmt.Sprint((int(part.Begin.Month())-1)/3 + 1)
+		year = fmt.Sprint(part.Begin.Year())
+		month = fmt.Sprintf("%02d", int(part.Begin.Month()))
+		monthName = part.Begin.Month().String()
+	}
+
+	// the dimensions come first, so they win over the calendar tokens of the same name
+	pairs := []string{}
+	for _, dim := range part.Dims {
+		pairs = append(pairs, "{part."+dim.Name+"}", DimValue(dim, cfg.Output.TimeFormat))
+		if !dim.Part.Begin.IsZero() {
+			dimBegin, dimEnd := PartitionBounds(dim.Part, cfg.Output.TimeFormat)
+			pairs = append(pairs, "{part."+dim.Name+".beg}", dimBegin, "{part."+dim.Name+".end}", dimEnd)
+		}
+	}
+
+	pairs = append(pairs,
+		"{num}", fmt.Sprint(num),
+		"{source.name}", source,
+		"{part.beg}", begin,
+		"{part.end}", end,
+		"{part.value}", part.Value,
+		"{part.quarter}", quarter,
+		"{part.q}", q,
+		"{part.year}", year,
+		"{part.month}", month,
+		"{part.monthname}", monthName,
+		"{part.index}", fmt.Sprint(index),
+	)
+
+	// zero padded variants, from {part.index:01d} to {part.index:09d}
+	for width := 1; width <= 9; width++ {
+		pairs = append(pairs, fmt.Sprintf("{part.index:0%dd}", width), fmt.Sprintf("%0*d", width, index))
+	}
+
+	return strings.NewReplacer(append(pairs, UserTokens(cfg)...)...)
+}
+
+// the template extensions, true for the macro enabled ones
+var templateExts = map[string]bool{
+	".xlsx": false,
+	".xltx": false,
+	".xlsm": true,
+	".xltm": true,
+}
+
+func OutputPath(
+	cfg Config,
+	tokens *strings.Replacer,
+) string {
+	// excelize sets the workbook content type from the extension on save, so
+	// the .xltx and .xltm templates become plain and macro enabled workbooks
+	ext := ".xlsx"
+	switch {
+	case cfg.Output.Type == "csv":
+		ext = ".csv"
+	case templateExts[strings.ToLower(filepath.Ext(cfg.Template.Path))]:
+		ext = ".xlsm"
+	}
+
+	if cfg.Output.Name == "-" {
+		return "-"
+	}
+
+	return filepath.Join(cfg.Output.Dir, tokens.Replace(cfg.Output.Name)+ext)
+}
+
+func CsvCopyPath(
+	cfg Config,
+	tokens *strings.Replacer,
+) string {
+	cfg.Output.Type = "csv"
+	return OutputPath(cfg, tokens)
+}
+
+// OpenOutput reopens the output workbook in inplace mode, clearing the query
+// data areas from the last run, or clones the template when it doesn't exist yet
+func OpenOutput(
+	cfg Config,
+	queries []Config,
+	tokens *strings.Replacer,
+) (*excelize.File, bool, error) {
+	dst := OutputPath(cfg, tokens)
+
+	_, err := os.Stat(dst)
+	if errors.Is(err, os.ErrNotExist) {
+		tpl, err := CloneTemplate(cfg, dst)
+		return tpl, false, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	tpl, err := LoadTemplate(dst)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// the stream writer replaces everything below start-row by itself
+	if !cfg.Output.Stream {
+		for _, qcfg := range queries {
+			err = ClearData(tpl, qcfg.Template.Sheet, qcfg.Template.Row, qcfg.Template.Col)
+			if err != nil {
+				tpl.Close()
+				return nil, false, err
+			}
+		}
+	}
+
+	return tpl, true, nil
+}
+
+// the start-row keeps its cell styles, as the data rows inherit them
+func ClearData(
+	tpl *excelize.File,
+	sheet string,
+	row int,
+	col int,
+) error {
+	rows, err := tpl.GetRows(sheet)
+	if err != nil {
+		return err
+	}
+
+	for r := len(rows); r > row; r-- {
+		err = tpl.RemoveRow(sheet, r)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(rows) >= row {
+		for c := col; c <= len(rows[row-1]); c++ {
+			axis, err := excelize.CoordinatesToCellName(c, row)
+			if err != nil {
+				return err
+			}
+			err = tpl.SetCellValue(sheet, axis, nil)
+			if err != nil {
+				return fmt.Errorf("writing cell %s: %w", axis, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// the partition files are written under a partial name and renamed once saved,
+// so a crashed run never leaves what looks like a finished file behind
+func PartialPath(
+	dst string,
+) string {
+	if dst == "-" {
+		return dst
+	}
+
+	return filepath.Join(filepath.Dir(dst), ".partial-"+filepath.Base(dst))
+}
+
+func CloneTemplate(
+	cfg Config,
+	dst string,
+) (*excelize.File, error) {
+	input, err := TemplateData(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// the workbook written to stdout is kept in memory only, without a path
+	if dst == "-" {
+		return excelize.OpenReader(bytes.NewReader(input))
+	}
+
+	err = ioutil.WriteFile(dst, input, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return LoadTemplate(dst)
+}
+
+func SheetName(
+	part Part,
+	layout string,
+) string {
+	if len(part.Dims) > 0 {
+		names := []string{}
+		for _, dim := range part.Dims {
+			names = append(names, SheetName(dim.Part, layout))
+		}
+		return strings.Join(names, " ")
+	}
+
+	if part.Begin.IsZero() {
+		return part.Value
+	}
+
+	begin, end := PartitionBounds(part, layout)
+	return begin + " - " + end
+}
+
+// the sheet-name template, or else the partition bounds or value, made a valid
+// and unique sheet name of the book; the sheets keep the name given to every
+// partition number, so a retry reuses it
+func PartitionSheet(
+	cfg Config,
+	book *excelize.File,
+	sheets map[int]string,
+	num int,
+	part Part,
+	tokens *strings.Replacer,
+) string {
+	if name, ok := sheets[num]; ok {
+		return name
+	}
+
+	name := SheetName(part, cfg.Output.TimeFormat)
+	if cfg.Output.SheetName != "" {
+		name = tokens.Replace(cfg.Output.SheetName)
+	}
+	name = SanitizeSheetName(name)
+	if book == nil {
+		return name
+	}
+
+	unique := name
+	for n := 2; book.GetSheetIndex(unique) != -1; n++ {
+		unique = SplitSheetName(name, n)
+	}
+	if sheets != nil {
+		sheets[num] = unique
+	}
+
+	return unique
+}
+
+// excel sheet names have at most 31 characters, none of []:*?/\ and don't
+// start or end with an apostrophe
+func SanitizeSheetName(
+	name string,
+) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return -1
+		}
+		return r
+	}, name)
+
+	runes := []rune(strings.Trim(name, "' "))
+	if len(runes) > 31 {
+		runes = runes[:31]
+	}
+	name = strings.Trim(string(runes), "' ")
+	if name == "" {
+		return "Sheet"
+	}
+
+	return name
+}
+
+func CopyTemplateSheet(
+	cfg Config,
+	book *excelize.File,
+	name string,
+) error {
+	from := book.GetSheetIndex(cfg.Template.Sheet)
+	if from == -1 {
+		return fmt.Errorf("template sheet not found: %s", cfg.Template.Sheet)
+	}
+
+	to := book.NewSheet(name)
+
+	return book.CopySheet(from, to)
+}
+
+var indexHeader = []interface{}{"Partition", "Begin", "End", "Rows", "Output"}
+
+// the links go to the partition sheets in sheets mode, or else to the partition
+// files, relative to the dir of the index file
+func WriteIndex(
+	book *excelize.File,
+	sheet string,
+	dir string,
+	results []Result,
+) error {
+	if book.GetSheetIndex(sheet) == -1 {
+		book.NewSheet(sheet)
+	}
+
+	style, err := book.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err != nil {
+		return err
+	}
+	err = book.SetSheetRow(sheet, "A1", &indexHeader)
+	if err != nil {
+		return err
+	}
+	err = book.SetCellStyle(sheet, "A1", "E1", style)
+	if err != nil {
+		return err
+	}
+
+	for i, res := range results {
+		r := i + 2
+		axis, err := excelize.CoordinatesToCellName(1, r)
+		if err != nil {
+			return err
+		}
+
+		// a relative url, so spaces and such in the file name are escaped
+		target, linkType := IndexTarget(dir, res.File), "External"
+		link := (&url.URL{Path: target}).String()
+		if res.Sheet != "" {
+			link = "'" + strings.ReplaceAll(res.Sheet, "'", "''") + "'!A1"
+			target, linkType = res.Sheet, "Location"
+		}
+
+		row := []interface{}{res.Partition, res.Begin, res.End, res.Rows, target}
+		err = book.SetSheetRow(sheet, axis, &row)
+		if err != nil {
+			return fmt.Errorf("writing cell %s: %w", axis, err)
+		}
+
+		axis, err = excelize.CoordinatesToCellName(5, r)
+		if err != nil {
+			return err
+		}
+		err = book.SetCellHyperLink(sheet, axis, link, linkType)
+		if err != nil {
+			return fmt.Errorf("writing cell %s: %w", axis, err)
+		}
+	}
+
+	return book.SetColWidth(sheet, "A", "E", 24)
+}
+
+// the output names may have subdirs, so the files are linked by their path
+// from the index, with forward slashes
+func IndexTarget(
+	dir string,
+	file string,
+) string {
+	rel, err := filepath.Rel(dir, file)
+	if err != nil {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return filepath.ToSlash(file)
+		}
+		return filepath.ToSlash(abs)
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+func SaveIndex(
+	cfg Config,
+	results []Result,
+) error {
+	book := excelize.NewFile()
+	defer book.Close()
+
+	book.SetSheetName("Sheet1", "Index")
+	err := WriteIndex(book, "Index", cfg.Output.Dir, results)
+	if err != nil {
+		return err
+	}
+
+	return book.SaveAs(filepath.Join(cfg.Output.Dir, "index.xlsx"))
+}
+
+// the summary has a row per partition with its totalization values, the
+// columns named after the cells above start-row like the chart series
+func WriteSummary(
+	book *excelize.File,
+	sheet string,
+	results []Result,
+) error {
+	if book.GetSheetIndex(sheet) == -1 {
+		book.NewSheet(sheet)
+	}
+
+	header := []interface{}{"Partition", "Begin", "End"}
+	for _, res := range results {
+		if len(res.Totals) > 0 {
+			for _, total := range res.Totals {
+				header = append(header, total.Name)
+			}
+			break
+		}
+	}
+
+	style, err := book.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err != nil {
+		return err
+	}
+	err = book.SetSheetRow(sheet, "A1", &header)
+	if err != nil {
+		return err
+	}
+	last, err := excelize.CoordinatesToCellName(len(header), 1)
+	if err != nil {
+		return err
+	}
+	err = book.SetCellStyle(sheet, "A1", last, style)
+	if err != nil {
+		return err
+	}
+
+	for i, res := range results {
+		axis, err := excelize.CoordinatesToCellName(1, i+2)
+		if err != nil {
+			return err
+		}
+
+		row := []interface{}{res.Partition, res.Begin, res.End}
+		for _, total := range res.Totals {
+			row = append(row, total.Value)
+		}
+		err = book.SetSheetRow(sheet, axis, &row)
+		if err != nil {
+			return fmt.Errorf("writing cell %s: %w", axis, err)
+		}
+	}
+
+	col, err := excelize.ColumnNumberToName(len(header))
+	if err != nil {
+		return err
+	}
+	return book.SetColWidth(sheet, "A", col, 24)
+}
+
+func SaveSummary(
+	cfg Config,
+	results []Result,
+) error {
+	book := excelize.NewFile()
+	defer book.Close()
+
+	book.SetSheetName("Sheet1", "Summary")
+	err := WriteSummary(book, "Summary", results)
+	if err != nil {
+		return err
+	}
+
+	return book.SaveAs(filepath.Join(cfg.Output.Dir, "summary.xlsx"))
+}
+
+// PartitionTotals computes the totalization cells of a written sheet, for the
+// summary; the formulas Excelize can't compute are left blank
+func PartitionTotals(
+	cfg Config,
+	tpl *excelize.File,
+	sheet string,
+	count int,
+) ([]Total, error) {
+	totals := []Total{}
+	for _, tot := range cfg.Output.Totalizations {
+		name := ""
+		if cfg.Template.Row > 1 {
+			above, err := excelize.CoordinatesToCellName(tot.Col, cfg.Template.Row-1)
+			if err != nil {
+				return nil, err
+			}
+			name, err = tpl.GetCellValue(sheet, above)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if name == "" {
+			col, err := excelize.ColumnNumberToName(tot.Col)
+			if err != nil {
+				return nil, err
+			}
+			name = "Total " + col
+		}
+
+		axis, err := excelize.CoordinatesToCellName(tot.Col, TotalizationRow(cfg, tot, count))
+		if err != nil {
+			return nil, err
+		}
+		text, err := tpl.CalcCellValue(sheet, axis)
+		if err != nil {
+			slog.Warn("can't compute the totalization", "sheet", sheet, "cell", axis, "error", err)
+		}
+
+		var value interface{} = text
+		if num, err := strconv.ParseFloat(text, 64); err == nil {
+			value = num
+		}
+		totals = append(totals, Total{Name: name, Value: value})
+	}
+
+	return totals, nil
+}
+
+// the document properties indexed by the document management systems, the
+// author also being the last one to modify it; the empty ones keep the template values
+func SetProperties(
+	cfg Config,
+	book *excelize.File,
+	tokens *strings.Replacer,
+) error {
+	props := cfg.Output.Properties
+	if props == nil {
+		return nil
+	}
+
+	return book.SetDocProps(&excelize.DocProperties{
+		Title:          tokens.Replace(props.Title),
+		Subject:        tokens.Replace(props.Subject),
+		Creator:        tokens.Replace(props.Author),
+		LastModifiedBy: tokens.Replace(props.Author),
+		Keywords:       tokens.Replace(props.Keywords),
+		Description:    tokens.Replace(props.Description),
+		Category:       tokens.Replace(props.Category),
+		Language:       props.Language,
+	})
+}
+
+func FinishBook(
+	cfg Config,
+	book *excelize.File,
+	results []Result,
+	tokens *strings.Replacer,
+) error {
+	// the template sheet itself is only kept when no partition was written
+	if len(results) > 0 {
+		book.DeleteSheet(cfg.Template.Sheet)
+		book.SetActiveSheet(0)
+	}
+
+	if cfg.Output.Index {
+		err := WriteIndex(book, "Index", filepath.Dir(book.Path), results)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.Output.Summary {
+		err := WriteSummary(book, "Summary", results)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := SetProperties(cfg, book, tokens)
+	if err != nil {
+		return err
+	}
+
+	if book.Path == "" {
+		err = book.Write(os.Stdout)
+	} else {
+		err = book.Save()
+	}
+	if err != nil {
+		return err
+	}
+
+	return book.Close()
+}
+
+func WriteRows(
+	cfg Config,
+	state *PartitionState,
+	tpl *excelize.File,
+	sheet string,
+	rows *sqlx.Rows,
+) (int, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return 0, err
+	}
+
+	if cfg.Output.Header {
+		err = WriteHeader(cfg, tpl, sheet, rows)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	styles, err := RowStyles(tpl, sheet, cfg.Template.Col, cfg.Template.Row, RowWidth(cfg, types))
+	if err != nil {
+		return 0, err
+	}
+
+	err = ColumnStyles(cfg, tpl, styles)
+	if err != nil {
+		return 0, err
+	}
+	err = ApplyRowStyles(tpl, sheet, cfg.Template.Col, cfg.Template.Row, cfg.Template.Row, styles)
+	if err != nil {
+		return 0, err
+	}
+
+	err = ColumnWidths(cfg, func(col int, width float64) error {
+		name, err := excelize.ColumnNumberToName(col)
+		if err != nil {
+			return err
+		}
+		return tpl.SetColWidth(sheet, name, name, width)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	kinds := ColumnKinds(cfg, RowWidth(cfg, types))
+	dateStyles := map[[2]int]int{}
+
+	widths := make([]int, RowWidth(cfg, types))
+	if cfg.Output.AutoFit && cfg.Output.Header {
+		names, err := ColumnNames(cfg, rows)
+		if err != nil {
+			return 0, err
+		}
+		for i, name := range names {
+			widths[i] = CellWidth(name)
+		}
+	}
+
+	computed, err := ComputedStyles(cfg, tpl, sheet)
+	if err != nil {
+		return 0, err
+	}
+
+	buffered, err := FooterRows(cfg, state, tpl, sheet, rows, types)
+	if err != nil {
+		return 0, err
+	}
+
+	r := int(cfg.Template.Row)
+	for {
+		var cols []interface{}
+		if buffered != nil {
+			if r-cfg.Template.Row >= len(buffered) {
+				break
+			}
+			cols = buffered[r-cfg.Template.Row]
+		} else {
+			if LimitReached(cfg, r-cfg.Template.Row) || !rows.Next() {
+				break
+			}
+			cols, err = ScanRow(cfg, state, rows, types)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		for i, col := range cols {
+			axis, err := excelize.CoordinatesToCellName(cfg.Template.Col+i, r)
+			if err != nil {
+				return 0, err
+			}
+			err = WriteCell(tpl, sheet, axis, col, kinds[i], dateStyles)
+			if err != nil {
+				return 0, fmt.Errorf("writing cell %s: %w", axis, err)
+			}
+			if cfg.Output.AutoFit {
+				widths[i] = max(widths[i], CellWidth(col))
+			}
+		}
+
+		for i, comp := range cfg.Output.ComputedColumns {
+			axis, err := excelize.CoordinatesToCellName(comp.Col, r)
+			if err != nil {
+				return 0, err
+			}
+			err = tpl.SetCellFormula(sheet, axis, ComputedFormula(comp, r))
+			if err == nil {
+				err = tpl.SetCellStyle(sheet, axis, axis, computed[i])
+			}
+			if err != nil {
+				return 0, fmt.Errorf("writing cell %s: %w", axis, err)
+			}
+		}
+
+		slog.Debug("wrote row", "sheet", sheet, "row", r)
+		ReportProgress(cfg, r-cfg.Template.Row+1)
+		r++
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	err = ApplyRowStyles(tpl, sheet, cfg.Template.Col, cfg.Template.Row+1, r-1, styles)
+	if err != nil {
+		return 0, err
+	}
+
+	if cfg.Output.AutoFit {
+		err = AutoFit(cfg, tpl, sheet, widths)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return r - cfg.Template.Row, nil
+}
+
+// FooterRows reads all the rows ahead when the template has content below
+// start-row to be preserved, and pushes that content down past the data; it
+// returns nil when there's nothing to preserve, so the rows are read as written
+func FooterRows(
+	cfg Config,
+	state *PartitionState,
+	tpl *excelize.File,
+	sheet string,
+	rows *sqlx.Rows,
+	types []*sql.ColumnType,
+) ([][]interface{}, error) {
+	if !cfg.Output.PreserveFooter {
+		return nil, nil
+	}
+
+	tplRows, err := tpl.GetRows(sheet)
+	if err != nil {
+		return nil, err
+	}
+	if len(tplRows) <= cfg.Template.Row {
+		return nil, nil
+	}
+
+	res := [][]interface{}{}
+	for !LimitReached(cfg, len(res)) && rows.Next() {
+		cols, err := ScanRow(cfg, state, rows, types)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, cols)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// only the template rows are below the insertion point, so this stays cheap
+	for i := 1; i < len(res); i++ {
+		err = tpl.InsertRow(sheet, cfg.Template.Row+1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// the width of the value as text, in characters
+func CellWidth(
+	value interface{},
+) int {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case time.Time:
+		return len("2006-01-02 15:04:05")
+	default:
+		return utf8.RuneCountInString(fmt.Sprint(v))
+	}
+}
+
+const defaultMaxWidth = 60
+
+// the columns are only widened, so the template widths act as a minimum
+func AutoFit(
+	cfg Config,
+	tpl *excelize.File,
+	sheet string,
+	widths []int,
+) error {
+	maxWidth := cfg.Output.MaxWidth
+	if maxWidth <= 0 {
+		maxWidth = defaultMaxWidth
+	}
+
+	for i, w := range widths {
+		name, err := excelize.ColumnNumberToName(cfg.Template.Col + i)
+		if err != nil {
+			return err
+		}
+
+		// some room for the cell padding and the filter buttons
+		width := min(float64(w)+2, maxWidth)
+
+		current, err := tpl.GetColWidth(sheet, name)
+		if err != nil {
+			return err
+		}
+		if width <= current {
+			continue
+		}
+
+		err = tpl.SetColWidth(sheet, name, name, width)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func ColumnKinds(
+	cfg Config,
+	count int,
+) []Column {
+	kinds := make([]Column, count)
+	for _, col := range cfg.Output.Columns {
+		i := col.Col - cfg.Template.Col
+		if i >= 0 && i < count {
+			kinds[i] = col
+		}
+	}
+
+	return kinds
+}
+
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+}
+
+func CoerceValue(
+	value interface{},
+	column Column,
+) interface{} {
+	if value == nil {
+		return nil
+	}
+
+	str, isStr := value.(string)
+
+	switch column.Type {
+	case "string", "text":
+		if t, ok := value.(time.Time); ok {
+			return t.Format(time.RFC3339)
+		}
+		return fmt.Sprint(value)
+	case "int", "integer":
+		if isStr {
+			if num, err := strconv.ParseInt(strings.TrimSpace(str), 10, 64); err == nil {
+				return num
+			}
+		}
+		if num, ok := value.(float64); ok {
+			return int64(num)
+		}
+	case "float", "number":
+		if isStr {
+			if num, err := strconv.ParseFloat(strings.TrimSpace(str), 64); err == nil {
+				return num
+			}
+		}
+	case "date", "datetime":
+		if isStr && column.Layout != "" {
+			if t, err := time.Parse(column.Layout, strings.TrimSpace(str)); err == nil {
+				return t
+			}
+		}
+		if isStr {
+			for _, layout := range dateLayouts {
+				if t, err := time.Parse(layout, strings.TrimSpace(str)); err == nil {
+					return t
+				}
+			}
+		}
+	}
+
+	return value
+}
+
+func WriteCell(
+	tpl *excelize.File,
+	sheet string,
+	axis string,
+	value interface{},
+	column Column,
+	dateStyles map[[2]int]int,
+) error {
+	value = CoerceValue(value, column)
+
+	switch v := value.(type) {
+	case nil:
+		// NULLs leave the cell blank, keeping its template style
+		return nil
+	case string:
+		return tpl.SetCellStr(sheet, axis, v)
+	case int64:
+		return tpl.SetCellInt(sheet, axis, int(v))
+	case float64:
+		return tpl.SetCellFloat(sheet, axis, v, -1, 64)
+	case time.Time:
+		base, err := tpl.GetCellStyle(sheet, axis)
+		if err != nil {
+			return err
+		}
+
+		err = tpl.SetCellValue(sheet, axis, v)
+		if err != nil {
+			return err
+		}
+
+		style, err := DateStyle(tpl, v, column.Type, base, dateStyles)
+		if err != nil || style == base {
+			return err
+		}
+		return tpl.SetCellStyle(sheet, axis, axis, style)
+	default:
+		return tpl.SetCellValue(sheet, axis, v)
+	}
+}
+
+// the align and format of a column replace its template style, like the
+// totalization ones
+func ColumnStyles(
+	cfg Config,
+	tpl *excelize.File,
+	styles []int,
+) error {
+	for _, column := range cfg.Output.Columns {
+		if column.Align == "" && column.Format == "" {
+			continue
+		}
+		i := column.Col - cfg.Template.Col
+		if i < 0 || i >= len(styles) {
+			continue
+		}
+
+		style := &excelize.Style{}
+		if column.Align != "" {
+			style.Alignment = &excelize.Alignment{Horizontal: column.Align}
+		}
+		if column.Format != "" {
+			style.CustomNumFmt = &column.Format
+		}
+
+		id, err := tpl.NewStyle(style)
+		if err != nil {
+			return fmt.Errorf("style of column %d: %w", column.Col, err)
+		}
+		styles[i] = id
+	}
+
+	return nil
+}
+
+func ColumnWidths(
+	cfg Config,
+	set func(col int, width float64) error,
+) error {
+	for _, column := range cfg.Output.Columns {
+		if column.Width > 0 {
+			err := set(column.Col, column.Width)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func RowStyles(
+	tpl *excelize.File,
+	sheet string,
+	col int,
+	row int,
+	count int,
+) ([]int, error) {
+	styles := make([]int, count)
+	for i := range styles {
+		axis, err := excelize.CoordinatesToCellName(col+i, row)
+		if err != nil {
+			return nil, err
+		}
+		styles[i], err = tpl.GetCellStyle(sheet, axis)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return styles, nil
+}
+
+func ApplyRowStyles(
+	tpl *excelize.File,
+	sheet string,
+	col int,
+	first int,
+	last int,
+	styles []int,
+) error {
+	if last < first {
+		return nil
+	}
+
+	for i, style := range styles {
+		if style == 0 {
+			continue
+		}
+		top, err := excelize.CoordinatesToCellName(col+i, first)
+		if err != nil {
+			return err
+		}
+		bottom, err := excelize.CoordinatesToCellName(col+i, last)
+		if err != nil {
+			return err
+		}
+		err = tpl.SetCellStyle(sheet, top, bottom, style)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// a date format from the template always wins over the default ones, which
+// are otherwise added to a copy of the template style, keeping its font, fill
+// and borders; the styles are cached by template style and format
+func DateStyle(
+	tpl *excelize.File,
+	value time.Time,
+	kind string,
+	base int,
+	dateStyles map[[2]int]int,
+) (int, error) {
+	numFmt := 22 // m/d/yy h:mm
+	hour, min, sec := value.Clock()
+	if kind == "date" || (kind != "datetime" && hour == 0 && min == 0 && sec == 0 && value.Nanosecond() == 0) {
+		numFmt = 14 // m/d/yyyy
+	}
+
+	key := [2]int{base, numFmt}
+	style, ok := dateStyles[key]
+	if ok {
+		return style, nil
+	}
+
+	// also loads the workbook styles read below
+	style, err := tpl.NewStyle(&excelize.Style{NumFmt: numFmt})
+	if err != nil {
+		return 0, err
+	}
+	if base != 0 {
+		style = WithNumFmt(tpl, base, style)
+	}
+	dateStyles[key] = style
+
+	return style, nil
+}
+
+// the built-in date and time formats, including the east asian ones
+var dateNumFmts = regexp.MustCompile(`^(1[4-9]|2[0-2]|2[7-9]|3[0-6]|4[5-7]|5[0-8])$`)
+
+// the date and time parts of a number format code, once its quoted text,
+// escaped characters and colors are dropped
+var dateCodes = regexp.MustCompile(`"[^"]*"|\\.|[_*].|\[[^\]]*\]`)
+
+// WithNumFmt returns the base style when it already has a date or time format,
+// or else a copy of it with the number format of the given style
+func WithNumFmt(
+	tpl *excelize.File,
+	base int,
+	from int,
+) int {
+	xfs := tpl.Styles.CellXfs
+	if base >= len(xfs.Xf) || xfs.Xf[from].NumFmtID == nil {
+		return from
+	}
+
+	if id := xfs.Xf[base].NumFmtID; id != nil {
+		if dateNumFmts.MatchString(fmt.Sprint(*id)) {
+			return base
+		}
+		if tpl.Styles.NumFmts != nil {
+			for _, numFmt := range tpl.Styles.NumFmts.NumFmt {
+				code := strings.ToLower(dateCodes.ReplaceAllString(numFmt.FormatCode, ""))
+				if numFmt.NumFmtID == *id && strings.ContainsAny(code, "ymdhs") {
+					return base
+				}
+			}
+		}
+	}
+
+	xf := xfs.Xf[base]
+	id, apply := *xfs.Xf[from].NumFmtID, true
+	xf.NumFmtID, xf.ApplyNumberFormat = &id, &apply
+	xfs.Xf = append(xfs.Xf, xf)
+	xfs.Count = len(xfs.Xf)
+
+	return len(xfs.Xf) - 1
+}
+
+// The stream writer replaces the whole sheet and only accepts rows in ascending
+// order, so the template rows above the data are copied first (values, styles,
+// formulas, heights and merged cells), followed by the header, the data and the
+// totalization row. Variables must therefore be placed above the data, and any
+// template content below start-row is dropped.
+func WriteStream(
+	cfg Config,
+	state *PartitionState,
+	tpl *excelize.File,
+	sheet string,
+	rows *sqlx.Rows,
+	tokens *strings.Replacer,
+) (int, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return 0, err
+	}
+
+	first := cfg.Template.Row
+	if cfg.Output.Header {
+		if cfg.Template.Row <= 1 {
+			return 0, errors.New("the header requires start-row to be greater than 1")
+		}
+		first--
+	}
+
+	variables := map[string]string{}
+	for _, variable := range cfg.Output.Variables {
+		if variable.Row >= first {
+			return 0, fmt.Errorf("in stream mode variables must be placed above row %d", first)
+		}
+		axis, err := excelize.CoordinatesToCellName(variable.Col, variable.Row)
+		if err != nil {
+			return 0, err
+		}
+		variables[axis] = tokens.Replace(variable.Value)
+	}
+
+	var names []string
+	if cfg.Output.Header {
+		names, err = ColumnNames(cfg, rows)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	tplRows, err := tpl.GetRows(sheet, excelize.Options{RawCellValue: true})
+	if err != nil {
+		return 0, err
+	}
+
+	above := make([][]interface{}, cfg.Template.Row-1)
+	heights := make([]float64, cfg.Template.Row-1)
+	for r := 1; r < cfg.Template.Row; r++ {
+		width := 0
+		if r <= len(tplRows) {
+			width = len(tplRows[r-1])
+		}
+		for _, variable := range cfg.Output.Variables {
+			if variable.Row == r && variable.Col > width {
+				width = variable.Col
+			}
+		}
+		if r == first && cfg.Output.Header && cfg.Template.Col+len(names)-1 > width {
+			width = cfg.Template.Col + len(names) - 1
+		}
+
+		cells := make([]interface{}, width)
+		for c := 1; c <= width; c++ {
+			axis, err := excelize.CoordinatesToCellName(c, r)
+			if err != nil {
+				return 0, err
+			}
+			style, err := tpl.GetCellStyle(sheet, axis)
+			if err != nil {
+				return 0, err
+			}
+			formula, err := tpl.GetCellFormula(sheet, axis)
+			if err != nil {
+				return 0, err
+			}
+
+			cell := excelize.Cell{StyleID: style, Formula: formula}
+			if value, ok := variables[axis]; ok {
+				cell.Value = value
+			} else if r <= len(tplRows) && c <= len(tplRows[r-1]) {
+				cell.Value = tplRows[r-1][c-1]
+			}
+			if i := c - cfg.Template.Col; r == first && cfg.Output.Header && i >= 0 && i < len(names) {
+				cell.Value = names[i]
+				cell.Formula = ""
+			}
+			cells[c-1] = cell
+		}
+		above[r-1] = cells
+
+		heights[r-1], err = tpl.GetRowHeight(sheet, r)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	merges, err := tpl.GetMergeCells(sheet)
+	if err != nil {
+		return 0, err
+	}
+
+	// the data and totalization rows take the styles of the whole template start-row
+	styles, err := RowStyles(tpl, sheet, 1, cfg.Template.Row, cfg.Template.Col-1+RowWidth(cfg, types))
+	if err != nil {
+		return 0, err
+	}
+	lead := cfg.Template.Col - 1
+
+	err = ColumnStyles(cfg, tpl, styles[lead:])
+	if err != nil {
+		return 0, err
+	}
+
+	computed, err := ComputedStyles(cfg, tpl, sheet)
+	if err != nil {
+		return 0, err
+	}
+
+	sw, err := tpl.NewStreamWriter(sheet)
+	if err != nil {
+		return 0, err
+	}
+
+	// the widths must come before the first row
+	err = ColumnWidths(cfg, func(col int, width float64) error {
+		return sw.SetColWidth(col, col, width)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for r, cells := range above {
+		axis, err := excelize.CoordinatesToCellName(1, r+1)
+		if err != nil {
+			return 0, err
+		}
+		err = sw.SetRow(axis, cells, excelize.RowOpts{Height: heights[r]})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, merge := range merges {
+		_, row, err := excelize.CellNameToCoordinates(merge.GetEndAxis())
+		if err != nil {
+			return 0, err
+		}
+		if row < first {
+			err = sw.MergeCell(merge.GetStartAxis(), merge.GetEndAxis())
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	kinds := ColumnKinds(cfg, RowWidth(cfg, types))
+	dateStyles := map[[2]int]int{}
+
+	r := cfg.Template.Row
+	for !LimitReached(cfg, r-cfg.Template.Row) && rows.Next() {
+		cols, err := ScanRow(cfg, state, rows, types)
+		if err != nil {
+			return 0, err
+		}
+
+		cells := make([]interface{}, lead+len(cols))
+		for i := 0; i < lead; i++ {
+			cells[i] = excelize.Cell{StyleID: styles[i]}
+		}
+		for i, col := range cols {
+			value := CoerceValue(col, kinds[i])
+			style := styles[lead+i]
+			if t, ok := value.(time.Time); ok {
+				style, err = DateStyle(tpl, t, kinds[i].Type, style, dateStyles)
+				if err != nil {
+					return 0, err
+				}
+			}
+			cells[lead+i] = excelize.Cell{StyleID: style, Value: value}
+		}
+		for i, comp := range cfg.Output.ComputedColumns {
+			for len(cells) < comp.Col {
+				cells = append(cells, nil)
+			}
+			cells[comp.Col-1] = excelize.Cell{StyleID: computed[i], Formula: ComputedFormula(comp, r)}
+		}
+
+		axis, err := excelize.CoordinatesToCellName(1, r)
+		if err != nil {
+			return 0, err
+		}
+		err = sw.SetRow(axis, cells)
+		if err != nil {
+			return 0, err
+		}
+
+		slog.Debug("wrote row", "sheet", sheet, "row", r)
+		ReportProgress(cfg, r-cfg.Template.Row+1)
+		r++
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// the sheet is still loaded while streaming, and its conditional formats and drawings are written on flush
+	err = ApplyConditionalFormats(cfg, tpl, sheet, r-1)
+	if err != nil {
+		return 0, err
+	}
+
+	err = AddCharts(cfg, tpl, sheet, r-1)
+	if err != nil {
+		return 0, err
+	}
+
+	if cfg.Output.Table {
+		first, last, format, err := TableRange(cfg, RowWidth(cfg, types), r-1)
+		if err != nil {
+			return 0, err
+		}
+		err = sw.AddTable(first, last, format)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// the filter is kept by the flush, like the conditional formats
+	if cfg.Output.AutoFilter {
+		first, last, _, err := TableRange(cfg, RowWidth(cfg, types), r-1)
+		if err != nil {
+			return 0, err
+		}
+		err = tpl.AutoFilter(sheet, first, last, "")
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	width := len(styles)
+	for _, tot := range cfg.Output.Totalizations {
+		if tot.Col > width {
+			width = tot.Col
+		}
+	}
+
+	// the offsets without totalizations are left as blank separator rows
+	for offset := 1; offset <= TotalizationRows(cfg); offset++ {
+		cells := []interface{}{}
+		for _, tot := range cfg.Output.Totalizations {
+			if TotalizationOffset(tot) != offset {
+				continue
+			}
+			if len(cells) == 0 {
+				cells = make([]interface{}, width)
+				for i, style := range styles {
+					cells[i] = excelize.Cell{StyleID: style}
+				}
+			}
+
+			style := 0
+			if tot.Col <= len(styles) {
+				style = styles[tot.Col-1]
+			}
+			style, err = TotalizationStyle(tpl, tot, style)
+			if err != nil {
+				return 0, err
+			}
+			formula, err := TotalizationFormula(cfg, tot, r-1, state.Split)
+			if err != nil {
+				return 0, err
+			}
+			cells[tot.Col-1] = excelize.Cell{StyleID: style, Formula: formula}
+		}
+		if len(cells) == 0 {
+			continue
+		}
+
+		axis, err := excelize.CoordinatesToCellName(1, r+offset-1)
+		if err != nil {
+			return 0, err
+		}
+		err = sw.SetRow(axis, cells)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// the comments and the protection are kept by the flush too
+	err = WriteComments(cfg, tpl, sheet, tokens)
+	if err != nil {
+		return 0, err
+	}
+
+	err = ProtectSheet(cfg, tpl, sheet)
+	if err != nil {
+		return 0, err
+	}
+
+	err = sw.Flush()
+	if err != nil {
+		return 0, err
+	}
+
+	return r - cfg.Template.Row, nil
+}
+
+// the computed cells take the style of their start-row cell, or their own number format
+func ComputedStyles(
+	cfg Config,
+	tpl *excelize.File,
+	sheet string,
+) ([]int, error) {
+	res := []int{}
+	for _, comp := range cfg.Output.ComputedColumns {
+		if comp.Format != "" {
+			style, err := tpl.NewStyle(ExcelStyle(Style{Format: comp.Format}))
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, style)
+			continue
+		}
+
+		axis, err := excelize.CoordinatesToCellName(comp.Col, cfg.Template.Row)
+		if err != nil {
+			return nil, err
+		}
+		style, err := tpl.GetCellStyle(sheet, axis)
+		if err != nil {
+			return nil, fmt.Errorf("reading cell %s: %w", axis, err)
+		}
+		res = append(res, style)
+	}
+
+	return res, nil
+}
+
+// the formulas are written once the rows are in place, each with its own row
+// number, and the rows later inserted for the totalizations are all below them
+func ComputedFormula(
+	comp ComputedColumn,
+	row int,
+) string {
+	return strings.ReplaceAll(comp.Formula, "{row}", fmt.Sprint(row))
+}
+
+// the sheet row of the totalization once the data is written: a fixed row above
+// start-row stays, one in the footer is pushed down with it past the data and the
+// inserted totalization rows, and the others are inserted below the data
+func TotalizationRow(
+	cfg Config,
+	tot Totalization,
+	count int,
+) int {
+	switch {
+	case tot.Row == 0:
+		return cfg.Template.Row + count + TotalizationOffset(tot) - 1
+	case tot.Row < cfg.Template.Row:
+		return tot.Row
+	default:
+		return tot.Row + max(count-1, 0) + TotalizationRows(cfg)
+	}
+}
+
+// the offset is relative to the last data row, the first one below the data by default
+func TotalizationOffset(
+	tot Totalization,
+) int {
+	if tot.Offset < 1 {
+		return 1
+	}
+	return tot.Offset
+}
+
+func TotalizationRows(
+	cfg Config,
+) int {
+	rows := 0
+	for _, tot := range cfg.Output.Totalizations {
+		if tot.Row == 0 && TotalizationOffset(tot) > rows {
+			rows = TotalizationOffset(tot)
+		}
+	}
+	return rows
+}
+
+var totalizationFuncs = map[string]string{
+	"sum":   "SUM",
+	"avg":   "AVERAGE",
+	"count": "COUNT",
+	"min":   "MIN",
+	"max":   "MAX",
+}
+
+func TotalizationFormula(
+	cfg Config,
+	tot Totalization,
+	last int,
+	split []SplitSheet,
+) (string, error) {
+	if tot.Formula != "" {
+		return strings.NewReplacer(
+			"{rows.first}", fmt.Sprint(cfg.Template.Row),
+			"{rows.last}", fmt.Sprint(last),
+			"{rows.count}", fmt.Sprint(last-cfg.Template.Row+1),
+		).Replace(tot.Formula), nil
+	}
+
+	first, err := excelize.CoordinatesToCellName(tot.Col, cfg.Template.Row)
+	if err != nil {
+		return "", err
+	}
+	bottom, err := excelize.CoordinatesToCellName(tot.Col, last)
+	if err != nil {
+		return "", err
+	}
+
+	// a split query also totals the sheets before, so the last one has the grand total
+	ranges := []string{}
+	for _, before := range split {
+		end, err := excelize.CoordinatesToCellName(tot.Col, before.Last)
+		if err != nil {
+			return "", err
+		}
+		ranges = append(ranges, fmt.Sprintf("'%s'!%s:%s", strings.ReplaceAll(before.Name, "'", "''"), first, end))
+	}
+	ranges = append(ranges, first+":"+bottom)
+
+	return fmt.Sprintf("=%s(%s)", totalizationFuncs[tot.Func], strings.Join(ranges, ",")), nil
+}
+
+func TotalizationStyle(
+	tpl *excelize.File,
+	tot Totalization,
+	copied int,
+) (int, error) {
+	own := Style{}
+	if tot.Style != nil {
+		own = *tot.Style
+	} else if tot.Format == "" {
+		return copied, nil
+	}
+	// format is a shorthand for the style number format
+	if tot.Format != "" {
+		own.Format = tot.Format
+	}
+
+	return tpl.NewStyle(ExcelStyle(own))
+}
+
+func ExcelStyle(
+	own Style,
+) *excelize.Style {
+	style := &excelize.Style{}
+	if own.Bold || own.Italic || own.Color != "" {
+		style.Font = &excelize.Font{
+			Bold:   own.Bold,
+			Italic: own.Italic,
+			Color:  own.Color,
+		}
+	}
+	if own.Fill != "" {
+		style.Fill = excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{own.Fill}}
+	}
+	if own.Format != "" {
+		style.CustomNumFmt = &own.Format
+	}
+
+	return style
+}
+
+// an absolute reference to a column range of the sheet, e.g. 'Sales'!$B$10:$B$40
+func ColumnRange(
+	sheet string,
+	col int,
+	first int,
+	last int,
+) (string, error) {
+	top, err := excelize.CoordinatesToCellName(col, first, true)
+	if err != nil {
+		return "", err
+	}
+	bottom, err := excelize.CoordinatesToCellName(col, last, true)
+	if err != nil {
+		return "", err
+	}
+
+	ref := "'" + strings.ReplaceAll(sheet, "'", "''") + "'!" + top
+	if last != first {
+		ref += ":" + bottom
+	}
+	return ref, nil
+}
+
+// the series are named after the cells above start-row, as the data header
+func AddCharts(
+	cfg Config,
+	tpl *excelize.File,
+	sheet string,
+	last int,
+) error {
+	if last < cfg.Template.Row {
+		return nil
+	}
+
+	for _, chart := range cfg.Output.Charts {
+		categories, err := ColumnRange(sheet, chart.Category, cfg.Template.Row, last)
+		if err != nil {
+			return err
+		}
+
+		series := []map[string]string{}
+		for _, col := range chart.Series {
+			values, err := ColumnRange(sheet, col, cfg.Template.Row, last)
+			if err != nil {
+				return err
+			}
+			serie := map[string]string{"categories": categories, "values": values}
+			if cfg.Template.Row > 1 {
+				serie["name"], err = ColumnRange(sheet, col, cfg.Template.Row-1, cfg.Template.Row-1)
+				if err != nil {
+					return err
+				}
+			}
+			series = append(series, serie)
+		}
+
+		format, err := json.Marshal(map[string]interface{}{
+			"type":   chart.Type,
+			"series": series,
+			"title":  map[string]string{"name": chart.Title},
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tpl.AddChart(sheet, chart.Cell, string(format))
+		if err != nil {
+			return fmt.Errorf("adding chart at %s: %w", chart.Cell, err)
+		}
+	}
+
+	return nil
+}
+
+var compareCriteria = map[string]string{
+	"lt":      "<",
+	"le":      "<=",
+	"gt":      ">",
+	"ge":      ">=",
+	"eq":      "==",
+	"ne":      "!=",
+	"between": "between",
+}
+
+// the rules cover the data rows of their columns; number formats aren't
+// supported by the conditional styles, only the font and fill
+func ApplyConditionalFormats(
+	cfg Config,
+	tpl *excelize.File,
+	sheet string,
+	last int,
+) error {
+	if last < cfg.Template.Row {
+		return nil
+	}
+
+	for _, cond := range cfg.Output.ConditionalFormats {
+		style, err := json.Marshal(ExcelStyle(cond.Style))
+		if err != nil {
+			return err
+		}
+		id, err := tpl.NewConditionalStyle(string(style))
+		if err != nil {
+			return err
+		}
+
+		rule := map[string]interface{}{
+			"type":     "cell",
+			"criteria": compareCriteria[cond.Compare],
+			"format":   id,
+		}
+		if cond.Compare == "between" {
+			rule["minimum"] = cond.Min
+			rule["maximum"] = cond.Max
+		} else {
+			rule["value"] = cond.Value
+		}
+		format, err := json.Marshal([]interface{}{rule})
+		if err != nil {
+			return err
+		}
+
+		first, err := excelize.CoordinatesToCellName(cond.Col, cfg.Template.Row)
+		if err != nil {
+			return err
+		}
+		bottom, err := excelize.CoordinatesToCellName(cond.Col, last)
+		if err != nil {
+			return err
+		}
+
+		err = tpl.SetConditionalFormat(sheet, first+":"+bottom, string(format))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func WriteComments(
+	cfg Config,
+	tpl *excelize.File,
+	sheet string,
+	tokens *strings.Replacer,
+) error {
+	for _, comment := range cfg.Output.Comments {
+		author := comment.Author
+		if author == "" {
+			author = "sql2excel"
+		}
+
+		format, err := json.Marshal(map[string]string{
+			"author": author,
+			"text":   tokens.Replace(comment.Text),
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tpl.AddComment(sheet, comment.Cell, string(format))
+		if err != nil {
+			return fmt.Errorf("writing the comment of cell %s: %w", comment.Cell, err)
+		}
+	}
+
+	return nil
+}
+
+var aggTokens = regexp.MustCompile(`\{agg\.(sum|avg|count|min|max)\.(\d+)\}`)
+
+// AggregateVariables replaces the {agg.func.N} tokens of the variables with the
+// sum, avg, count, min or max of the numbers written to the sheet column N
+func AggregateVariables(
+	cfg Config,
+	tpl *excelize.File,
+	sheet string,
+	count int,
+) ([]Variable, error) {
+	res := make([]Variable, len(cfg.Output.Variables))
+	for i, variable := range cfg.Output.Variables {
+		var err error
+		variable.Value = aggTokens.ReplaceAllStringFunc(variable.Value, func(token string) string {
+			match := aggTokens.FindStringSubmatch(token)
+			col, _ := strconv.Atoi(match[2])
+
+			var value string
+			value, err = Aggregate(cfg, tpl, sheet, count, match[1], col)
+			return value
+		})
+		if err != nil {
+			return nil, err
+		}
+		res[i] = variable
+	}
+
+	return res, nil
+}
+
+// the cells that aren't numbers are skipped, like Excel does
+func Aggregate(
+	cfg Config,
+	tpl *excelize.File,
+	sheet string,
+	count int,
+	fn string,
+	col int,
+) (string, error) {
+	sum, n := 0.0, 0
+	lo, hi := 0.0, 0.0
+	for r := cfg.Template.Row; r < cfg.Template.Row+count; r++ {
+		axis, err := excelize.CoordinatesToCellName(col, r)
+		if err != nil {
+			return "", err
+		}
+		text, err := tpl.GetCellValue(sheet, axis, excelize.Options{RawCellValue: true})
+		if err != nil {
+			return "", err
+		}
+		num, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			continue
+		}
+
+		if n == 0 || num < lo {
+			lo = num
+		}
+		if n == 0 || num > hi {
+			hi = num
+		}
+		sum += num
+		n++
+	}
+
+	var value float64
+	switch fn {
+	case "sum":
+		value = sum
+	case "count":
+		value = float64(n)
+	case "avg", "min", "max":
+		if n == 0 {
+			return "", nil
+		}
+		value = map[string]float64{"avg": sum / float64(n), "min": lo, "max": hi}[fn]
+	}
+
+	// 15 significant digits, as shown by Excel, so the float sums don't show their rounding errors
+	return strconv.FormatFloat(value, 'g', 15, 64), nil
+}
+
+func WriteVariables(
+	cfg Config,
+	tpl *excelize.File,
+	sheet string,
+	tokens *strings.Replacer,
+) error {
+	for _, variable := range cfg.Output.Variables {
+		axis, err := excelize.CoordinatesToCellName(variable.Col, variable.Row)
+		if err != nil {
+			return err
+		}
+		err = tpl.SetCellStr(sheet, axis, tokens.Replace(variable.Value))
+		if err != nil {
+			return fmt.Errorf("writing cell %s: %w", axis, err)
+		}
+	}
+
+	return nil
+}
+
+func WriteTotalizations(
+	cfg Config,
+	tpl *excelize.File,
+	sheet string,
+	r int,
+	split []SplitSheet,
+) error {
+	for i := 0; i < TotalizationRows(cfg); i++ {
+		err := tpl.InsertRow(sheet, r)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, tot := range cfg.Output.Totalizations {
+		axis, err := excelize.CoordinatesToCellName(tot.Col, TotalizationRow(cfg, tot, r-cfg.Template.Row))
+		if err != nil {
+			return err
+		}
+		// the fixed cells keep their own template style
+		above, err := excelize.CoordinatesToCellName(tot.Col, r-1)
+		if err != nil {
+			return err
+		}
+		if tot.Row != 0 {
+			above = axis
+		}
+		formula, err := TotalizationFormula(cfg, tot, r-1, split)
+		if err != nil {
+			return err
+		}
+		style, err := tpl.GetCellStyle(sheet, above)
+		if err != nil {
+			return fmt.Errorf("reading cell %s: %w", above, err)
+		}
+		style, err = TotalizationStyle(tpl, tot, style)
+		if err != nil {
+			return err
+		}
+		err = tpl.SetCellFormula(sheet, axis, formula)
+		if err != nil {
+			return fmt.Errorf("writing cell %s: %w", axis, err)
+		}
+		err = tpl.SetCellStyle(sheet, axis, axis, style)
+		if err != nil {
+			return fmt.Errorf("writing cell %s: %w", axis, err)
+		}
+	}
+
+	return nil
+}
+
+func PartitionQuery(
+	cfg Config,
+	bindType int,
+	values map[string]string,
+) (string, []interface{}) {
+	// the partition numbers are plain integers, so they are written literally in bind mode too
+	pairs := []string{
+		"{part.num}", values["{part.num}"],
+		"{part.index}", values["{part.index}"],
+	}
+	query := strings.NewReplacer(append(pairs, UserTokens(cfg)...)...).Replace(cfg.Input.Query)
+
+	if cfg.Input.Bind {
+		return BindQuery(bindType, query, values)
+	}
+
+	query = partTokens.ReplaceAllStringFunc(query, func(token string) string {
+		value, ok := values[token]
+		if !ok {
+			return token
+		}
+		return value
+	})
+
+	return query, nil
+}
+
+// the table spans the row above start-row, holding its column names, down to the
+// last data row, or a blank one when there's no data
+func TableRange(
+	cfg Config,
+	cols int,
+	lastRow int,
+) (string, string, string, error) {
+	first, err := excelize.CoordinatesToCellName(cfg.Template.Col, cfg.Template.Row-1)
+	if err != nil {
+		return "", "", "", err
+	}
+	last, err := excelize.CoordinatesToCellName(cfg.Template.Col+cols-1, max(lastRow, cfg.Template.Row))
+	if err != nil {
+		return "", "", "", err
+	}
+
+	style := cfg.Output.TableStyle
+	if style == "" {
+		style = "TableStyleMedium2"
+	}
+	format, err := json.Marshal(map[string]interface{}{
+		"table_style":      style,
+		"show_row_stripes": true,
+	})
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return first, last, string(format), nil
+}
+
+// freeze-header keeps the rows above start-row visible, freeze-panes the rows
+// above and the columns left of the given cell
+func FreezePanes(
+	cfg Config,
+	tpl *excelize.File,
+	sheet string,
+) error {
+	col, row := 1, 1
+	switch {
+	case cfg.Output.FreezePanes != "":
+		var err error
+		col, row, err = excelize.CellNameToCoordinates(cfg.Output.FreezePanes)
+		if err != nil {
+			return err
+		}
+	case cfg.Output.FreezeHeader:
+		row = cfg.Template.Row
+	}
+	if col == 1 && row == 1 {
+		return nil
+	}
+
+	topLeft, err := excelize.CoordinatesToCellName(col, row)
+	if err != nil {
+		return err
+	}
+
+	pane := "bottomRight"
+	switch {
+	case col == 1:
+		pane = "bottomLeft"
+	case row == 1:
+		pane = "topRight"
+	}
+
+	return tpl.SetPanes(sheet, fmt.Sprintf(
+		`{"freeze":true,"split":false,"x_split":%d,"y_split":%d,"top_left_cell":"%s","active_pane":"%s"}`,
+		col-1, row-1, topLeft, pane,
+	))
+}
+
+// WriteQuery fills the sheet, continuing on copies of it named sheet_2,
+// sheet_3... each time max-rows-per-sheet is reached
+func WriteQuery(
+	cfg Config,
+	state *PartitionState,
+	tpl *excelize.File,
+	sheet string,
+	rows *sqlx.Rows,
+	tokens *strings.Replacer,
+) (int, error) {
+	if cfg.Output.MaxRowsPerSheet == 0 {
+		return WriteSheet(cfg, state, tpl, sheet, rows, tokens)
+	}
+
+	// the copies are taken from the sheet as it was before being filled
+	from := tpl.GetSheetIndex(sheet)
+	if from == -1 {
+		return 0, fmt.Errorf("sheet not found: %s", sheet)
+	}
+	spare := SplitSheetName(sheet, 0)
+	err := tpl.CopySheet(from, tpl.NewSheet(spare))
+	if err != nil {
+		return 0, err
+	}
+	defer tpl.DeleteSheet(spare)
+
+	total := 0
+	name := sheet
+	var split []SplitSheet
+	for n := 1; ; n++ {
+		if n > 1 {
+			name = SplitSheetName(sheet, n)
+			err = tpl.CopySheet(tpl.GetSheetIndex(spare), tpl.NewSheet(name))
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		scfg := cfg
+		scfg.Output.Limit = cfg.Output.MaxRowsPerSheet
+		if cfg.Output.Limit > 0 {
+			scfg.Output.Limit = min(scfg.Output.Limit, cfg.Output.Limit-total)
+		}
+
+		sstate := *state
+		sstate.Split = split
+		count, err := WriteSheet(scfg, &sstate, tpl, name, rows, tokens)
+		if err != nil {
+			return 0, err
+		}
+		// the rows ran out right at the end of the sheet before
+		if n > 1 && count == 0 {
+			tpl.DeleteSheet(name)
+			break
+		}
+
+		total += count
+		if count < scfg.Output.Limit || total == cfg.Output.Limit {
+			break
+		}
+		split = append(split, SplitSheet{Name: name, Last: cfg.Template.Row + count - 1})
+	}
+
+	return total, nil
+}
+
+// sheet names are limited to 31 characters, so long ones are cut before the suffix
+func SplitSheetName(
+	sheet string,
+	n int,
+) string {
+	suffix := fmt.Sprintf("_%d", n)
+	runes := []rune(sheet)
+	if len(runes)+len(suffix) > 31 {
+		runes = runes[:31-len(suffix)]
+	}
+
+	return string(runes) + suffix
+}
+
+func WriteSheet(
+	cfg Config,
+	state *PartitionState,
+	tpl *excelize.File,
+	sheet string,
+	rows *sqlx.Rows,
+	tokens *strings.Replacer,
+) (int, error) {
+	// set before writing, as the stream writer only keeps the sheet views it started with
+	err := FreezePanes(cfg, tpl, sheet)
+	if err != nil {
+		return 0, err
+	}
+
+	if cfg.Output.Stream {
+		return WriteStream(cfg, state, tpl, sheet, rows, tokens)
+	}
+
+	// the column count is gone once all the rows are read
+	names, err := ColumnNames(cfg, rows)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := WriteRows(cfg, state, tpl, sheet, rows)
+	if err != nil {
+		return 0, err
+	}
+
+	err = ApplyConditionalFormats(cfg, tpl, sheet, cfg.Template.Row+count-1)
+	if err != nil {
+		return 0, err
+	}
+
+	err = AddCharts(cfg, tpl, sheet, cfg.Template.Row+count-1)
+	if err != nil {
+		return 0, err
+	}
+
+	if cfg.Output.Table {
+		first, last, format, err := TableRange(cfg, len(names), cfg.Template.Row+count-1)
+		if err != nil {
+			return 0, err
+		}
+		err = tpl.AddTable(sheet, first, last, format)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// from the header through the last data row, leaving out the totalizations
+	if cfg.Output.AutoFilter {
+		first, last, _, err := TableRange(cfg, len(names), cfg.Template.Row+count-1)
+		if err != nil {
+			return 0, err
+		}
+		err = tpl.AutoFilter(sheet, first, last, "")
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	cfg.Output.Variables, err = AggregateVariables(cfg, tpl, sheet, count)
+	if err != nil {
+		return 0, err
+	}
+
+	err = WriteVariables(cfg, tpl, sheet, tokens)
+	if err != nil {
+		return 0, err
+	}
+
+	err = WriteComments(cfg, tpl, sheet, tokens)
+	if err != nil {
+		return 0, err
+	}
+
+	err = WriteTotalizations(cfg, tpl, sheet, cfg.Template.Row+count, state.Split)
+	if err != nil {
+		return 0, err
+	}
+
+	// last, so nothing of the above is locked out
+	err = ProtectSheet(cfg, tpl, sheet)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// the operations a protected sheet may allow, each one unlocking some of the
+// protection flags
+func SheetLocks(
+	p *excelize.FormatSheetProtection,
+) map[string][]*bool {
+	return map[string][]*bool{
+		"select":            {&p.SelectLockedCells, &p.SelectUnlockedCells},
+		"select-unlocked":   {&p.SelectUnlockedCells},
+		"sort":              {&p.Sort},
+		"autofilter":        {&p.AutoFilter},
+		"format-cells":      {&p.FormatCells},
+		"format-columns":    {&p.FormatColumns},
+		"format-rows":       {&p.FormatRows},
+		"insert-columns":    {&p.InsertColumns},
+		"insert-rows":       {&p.InsertRows},
+		"insert-hyperlinks": {&p.InsertHyperlinks},
+		"delete-columns":    {&p.DeleteColumns},
+		"delete-rows":       {&p.DeleteRows},
+		"pivot-tables":      {&p.PivotTables},
+		"edit-objects":      {&p.EditObjects},
+		"edit-scenarios":    {&p.EditScenarios},
+	}
+}
+
+// every operation is locked but the allowed ones, selecting cells by default
+func ProtectSheet(
+	cfg Config,
+	tpl *excelize.File,
+	sheet string,
+) error {
+	if cfg.Output.Protect == nil {
+		return nil
+	}
+
+	p := &excelize.FormatSheetProtection{Password: cfg.Output.Protect.Password}
+	if p.Password != "" {
+		p.AlgorithmName = "SHA-512"
+	}
+
+	locks := SheetLocks(p)
+	for _, flags := range locks {
+		for _, flag := range flags {
+			*flag = true
+		}
+	}
+
+	allow := cfg.Output.Protect.Allow
+	if allow == nil {
+		allow = []string{"select"}
+	}
+	for _, op := range allow {
+		for _, flag := range locks[op] {
+			*flag = false
+		}
+	}
+
+	return tpl.ProtectSheet(sheet, p)
+}
+
+func Process(
+	ctx context.Context,
+	cfg Config,
+	source Source,
+	db *sqlx.DB,
+	total int,
+	partitions []Part,
+	book *excelize.File,
+	sheets map[int]string,
+) ([]Result, error) {
+	res := []Result{}
+
+	driver, err := DriverName(cfg.Input.Type)
+	if err != nil {
+		return res, err
+	}
+	bindType := sqlx.BindType(driver)
+
+	// a single workbook in sheets mode keeps the global output name
+	if source.OutputName != "" && book == nil {
+		cfg.Output.Name = source.OutputName
+	}
+
+	queries := QueryConfigs(cfg)
+	label := SourceLabel(cfg.Input.Type, source)
+
+	if cfg.Output.Name == "-" && book == nil && total-1+len(partitions) > 1 && !cfg.DryRun {
+		return res, errors.New("the output name - writes a single file to stdout, so it requires a single partition or the sheets mode")
+	}
+
+	// the sheets of a single workbook and the dry run output can't be written concurrently
+	workers := cfg.Workers
+	if workers < 1 || book != nil || cfg.DryRun {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// every partition keeps its slot, so the results don't depend on the workers scheduling
+	results := make([]*Result, len(partitions))
+	errs := make(chan error, workers)
+	jobs := make(chan int)
+
+	var mu sync.Mutex
+	failures := Failures{}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				var r *Result
+				what := "partition " + PartitionLabel(cfg, partitions[p])
+				err := Retry(ctx, cfg, what, func() (err error) {
+					r, err = ProcessPartition(ctx, cfg, label, db, bindType, queries, total+p, p+1, partitions[p], book, sheets)
+					return err
+				})
+				if err != nil {
+					err = fmt.Errorf("%s: %w", what, err)
+					if cfg.ContinueOnError && ctx.Err() == nil {
+						slog.Error("partition failed, continuing", "source", label, "error", err)
+						mu.Lock()
+						failures = append(failures, fmt.Errorf("source %s: %w", label, err))
+						mu.Unlock()
+						continue
+					}
+					errs <- err
+					cancel()
+					return
+				}
+				results[p] = r
+			}
+		}()
+	}
+
+feed:
+	for p := range partitions {
+		select {
+		case jobs <- p:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+
+	err = <-errs
+	for _, r := range results {
+		if r != nil {
+			res = append(res, *r)
+		}
+	}
+
+	WarnColumnChanges(res)
+
+	if err == nil && len(failures) > 0 {
+		return res, failures
+	}
+	return res, err
+}
+
+// the header follows the columns of each partition, but a changed column count
+// misaligns the data with the template columns and the column settings
+func WarnColumnChanges(
+	results []Result,
+) {
+	for i := 1; i < len(results); i++ {
+		prev, cur := results[i-1].Columns, results[i].Columns
+		for q := 0; q < len(cur) && q < len(prev); q++ {
+			if cur[q] != prev[q] {
+				slog.Warn("the column count changed", "partition", results[i].Partition, "query", q+1, "columns", cur[q], "previous", prev[q])
+			}
+		}
+	}
+}
+
+// MergeSources writes a workbook per partition with a sheet per source, the
+// partitions taken from the first source
+func MergeSources(
+	ctx context.Context,
+	cfg Config,
+) ([]Result, error) {
+	res := []Result{}
+
+	driver, err := DriverName(cfg.Input.Type)
+	if err != nil {
+		return res, err
+	}
+	bindType := sqlx.BindType(driver)
+
+	dbs := make([]*sqlx.DB, len(cfg.Input.Sources))
+	if !cfg.DryRun {
+		for i, source := range cfg.Input.Sources {
+			var closeDb func()
+			err = Retry(ctx, cfg, "source "+SourceLabel(cfg.Input.Type, source), func() (err error) {
+				dbs[i], closeDb, err = OpenDb(cfg.Input.Type, source)
+				return err
+			})
+			if err != nil {
+				return res, err
+			}
+			defer closeDb()
+		}
+	}
+
+	partitions, err := SourcePartitions(cfg.Input.Sources[0], dbs[0])
+	if err != nil {
+		return res, err
+	}
+
+	queries := QueryConfigs(cfg)
+	failures := Failures{}
+
+	for p, part := range partitions {
+		if ctx.Err() != nil {
+			return res, ctx.Err()
+		}
+
+		begin, end := PartitionBounds(part, cfg.Output.TimeFormat)
+		tokens := PartitionTokens(cfg, "", p+1, p+1, part, begin, end)
+		label := PartitionLabel(cfg, part)
+		start := time.Now()
+
+		dst := OutputPath(cfg, tokens)
+		if cfg.Output.SkipExisting {
+			info, err := os.Stat(dst)
+			if err == nil && info.Size() > 0 {
+				slog.Info("skipping existing partition", "partition", label, "file", dst)
+				continue
+			}
+		}
+
+		if cfg.DryRun {
+			for _, source := range cfg.Input.Sources {
+				_, err = ProcessPartition(ctx, cfg, SourceLabel(cfg.Input.Type, source), nil, bindType, queries, p+1, p+1, part, nil, nil)
+				if err != nil {
+					return res, err
+				}
+			}
+			continue
+		}
+
+		book, err := CloneTemplate(cfg, PartialPath(dst))
+		if err != nil {
+			return res, err
+		}
+
+		sheets := []Result{}
+		for i, source := range cfg.Input.Sources {
+			var r *Result
+			what := "partition " + label + " of source " + SourceLabel(cfg.Input.Type, source)
+			err = Retry(ctx, cfg, what, func() (err error) {
+				r, err = ProcessPartition(ctx, cfg, SourceLabel(cfg.Input.Type, source), dbs[i], bindType, queries, p+1, p+1, part, book, nil)
+				return err
+			})
+			if err != nil {
+				err = fmt.Errorf("%s: %w", what, err)
+			}
+			if err != nil {
+				break
+			}
+			if r != nil {
+				sheets = append(sheets, *r)
+			}
+		}
+		if err != nil {
+			book.Close()
+			os.Remove(book.Path)
+			if cfg.ContinueOnError && ctx.Err() == nil {
+				slog.Error("partition failed, continuing", "error", err)
+				failures = append(failures, err)
+				continue
+			}
+			return res, err
+		}
+
+		count := 0
+		for _, r := range sheets {
+			count += r.Rows
+		}
+
+		if len(sheets) == 0 && cfg.Output.SkipEmpty {
+			slog.Info("skipping empty partition")
+			book.Close()
+			os.Remove(book.Path)
+			continue
+		}
+
+		err = FinishBook(cfg, book, sheets, tokens)
+		if err == nil {
+			err = os.Rename(book.Path, dst)
+		}
+		if err != nil {
+			os.Remove(book.Path)
+			return res, err
+		}
+
+		slog.Info("wrote partition", "partition", label, "rows", count, "file", dst, "elapsed", time.Since(start).Round(time.Millisecond).String())
+		err = PostCommand(ctx, cfg, tokens, dst)
+		if err != nil {
+			return res, err
+		}
+
+		res = append(res, Result{Partition: label, Begin: begin, End: end, File: dst, Rows: count})
+	}
+
+	if len(failures) > 0 {
+		return res, failures
+	}
+	return res, nil
+}
+
+// the bounds are blank for the column partitions
+func PartitionBounds(
+	part Part,
+	layout string,
+) (string, string) {
+	if part.Begin.IsZero() {
+		return "", ""
+	}
+
+	return part.Begin.Format(layout), part.End.Format(layout)
+}
+
+func PartitionLabel(
+	cfg Config,
+	part Part,
+) string {
+	if len(part.Dims) > 0 {
+		labels := []string{}
+		for _, dim := range part.Dims {
+			labels = append(labels, PartitionLabel(cfg, dim.Part))
+		}
+		return strings.Join(labels, ", ")
+	}
+
+	if part.Begin.IsZero() {
+		return part.Value
+	}
+
+	return part.Begin.Format(cfg.Output.TimeFormat) + " to " + part.End.Format(cfg.Output.TimeFormat)
+}
+
+// Retry runs again what failed with a transient error, waiting 1s, 2s, 4s and so
+// on between the attempts; the partitions are retried from scratch, as their
+// output is discarded on errors
+func Retry(
+	ctx context.Context,
+	cfg Config,
+	what string,
+	run func() error,
+) error {
+	for attempt := 0; ; attempt++ {
+		err := run()
+		if err == nil || attempt >= cfg.Input.Retries || !IsTransient(err) {
+			return err
+		}
+
+		delay := time.Second << attempt
+		slog.Warn("retrying", "what", what, "attempt", attempt+1, "delay", delay, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// connection losses, deadlocks and busy databases are worth a retry, unlike
+// syntax or permission errors and the canceled or timed out queries
+func IsTransient(
+	err error,
+) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	for _, target := range []error{
+		driver.ErrBadConn,
+		mysql.ErrInvalidConn,
+		io.EOF,
+		io.ErrUnexpectedEOF,
+		syscall.ECONNRESET,
+		syscall.EPIPE,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	// only the timeouts, as an unknown host or a refused connection won't get better
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Timeout()
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// connection exceptions, transaction rollbacks (e.g. deadlocks), insufficient
+		// resources and server shutdowns, but not the statement timeouts
+		if pqErr.Code == "57014" {
+			return false
+		}
+		switch pqErr.Code.Class() {
+		case "08", "40", "53", "57":
+			return true
+		}
+		return false
+	}
+
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		// lock wait timeout, deadlock, too many connections
+		switch myErr.Number {
+		case 1205, 1213, 1040:
+			return true
+		}
+		return false
+	}
+
+	var liteErr sqlite3.Error
+	if errors.As(err, &liteErr) {
+		return liteErr.Code == sqlite3.ErrBusy || liteErr.Code == sqlite3.ErrLocked
+	}
+
+	var msErr mssql.Error
+	if errors.As(err, &msErr) {
+		// deadlock victim
+		return msErr.Number == 1205
+	}
+
+	return false
+}
+
+func ProcessPartition(
+	ctx context.Context,
+	cfg Config,
+	source string,
+	db *sqlx.DB,
+	bindType int,
+	queries []Config,
+	num int,
+	index int,
+	part Part,
+	book *excelize.File,
+	sheets map[int]string,
+) (*Result, error) {
+	// the queries get the bounds in the input format, the rest in the output one
+	begin, end := PartitionBounds(part, cfg.Output.TimeFormat)
+	qbegin, qend := PartitionBounds(part, cfg.Input.TimeFormat)
+
+	tokens := PartitionTokens(cfg, source, num, index, part, begin, end)
+	state := &PartitionState{Source: source}
+
+	values := map[string]string{
+		"{part.beg}":   qbegin,
+		"{part.end}":   qend,
+		"{part.value}": part.Value,
+		"{part.num}":   fmt.Sprint(num),
+		"{part.index}": fmt.Sprint(index),
+	}
+	for _, dim := range part.Dims {
+		values["{part."+dim.Name+"}"] = DimValue(dim, cfg.Input.TimeFormat)
+		if !dim.Part.Begin.IsZero() {
+			values["{part."+dim.Name+".beg}"], values["{part."+dim.Name+".end}"] = PartitionBounds(dim.Part, cfg.Input.TimeFormat)
+		}
+	}
+
+	label := PartitionLabel(cfg, part)
+	slog.Info("processing partition", "partition", label)
+	start := time.Now()
+
+	dst := OutputPath(cfg, tokens)
+	if cfg.Output.SkipExisting && book == nil {
+		info, err := os.Stat(dst)
+		if err == nil && info.Size() > 0 {
+			slog.Info("skipping existing partition", "partition", label, "file", dst)
+			return nil, nil
+		}
+	}
+
+	if cfg.DryRun {
+		target := dst
+		if cfg.Output.Mode == "sheets" {
+			target = OutputPath(cfg, PartitionTokens(cfg, "", 1, 1, Part{}, "", "")) + ", sheet " + PartitionSheet(cfg, nil, nil, num, part, tokens)
+		} else if cfg.Output.MergeSources {
+			target = OutputPath(cfg, PartitionTokens(cfg, "", num, index, part, begin, end)) + ", sheet " + source
+		}
+		fmt.Printf("Would write %s\n", target)
+		if CsvCopy(cfg) {
+			fmt.Printf("Would write %s\n", CsvCopyPath(cfg, tokens))
+		}
+		for _, qcfg := range queries {
+			query, args := PartitionQuery(qcfg, bindType, values)
+			fmt.Printf("With query: %s\n", query)
+			if len(args) > 0 {
+				fmt.Printf("With args: %v\n", args)
+			}
+		}
+		return nil, nil
+	}
+
+	// the timeout only applies to the queries, not to the post command
+	qctx := ctx
+	if cfg.Input.Timeout != "" {
+		timeout, _ := time.ParseDuration(cfg.Input.Timeout)
+		var cancel context.CancelFunc
+		qctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if cfg.Output.Type == "csv" {
+		query, args := PartitionQuery(queries[0], bindType, values)
+		LogQuery(query, args)
+		rows, err := db.QueryxContext(qctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		if cfg.Output.Pivot != nil {
+			var closePivot func()
+			rows, closePivot, err = PivotRows(cfg, rows)
+			if err != nil {
+				return nil, err
+			}
+			defer closePivot()
+		}
+
+		names, err := rows.Columns()
+		if err != nil {
+			return nil, err
+		}
+
+		count, err := WriteCsv(cfg, state, PartialPath(dst), rows)
+		if err != nil {
+			if dst != "-" {
+				os.Remove(PartialPath(dst))
+			}
+			return nil, err
+		}
+		if count == 0 && cfg.Output.SkipEmpty {
+			return nil, nil
+		}
+		if dst != "-" {
+			err = os.Rename(PartialPath(dst), dst)
+			if err != nil {
+				return nil, err
+			}
+		}
+		slog.Info("wrote partition", "partition", label, "rows", count, "file", dst, "elapsed", time.Since(start).Round(time.Millisecond).String())
+		err = PostCommand(ctx, cfg, tokens, dst)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{Partition: label, Begin: begin, End: end, File: dst, Rows: count, Columns: []int{len(names)}}, nil
+	}
+
+	var err error
+	tpl := book
+	sheet := ""
+	existing := false
+	if book == nil {
+		if cfg.Output.Mode == "inplace" {
+			tpl, existing, err = OpenOutput(cfg, queries, tokens)
+		} else {
+			tpl, err = CloneTemplate(cfg, PartialPath(dst))
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer tpl.Close()
+	} else {
+		sheet = PartitionSheet(cfg, book, sheets, num, part, tokens)
+		if cfg.Output.MergeSources {
+			sheet = SanitizeSheetName(source)
+		}
+		err = CopyTemplateSheet(cfg, book, sheet)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the csv copy holds all the rows in memory until the xlsx file is saved
+	var capture *Capture
+	if CsvCopy(cfg) {
+		capture = &Capture{}
+	}
+	state.Capture = capture
+
+	count := 0
+	columns := []int{}
+	totals := []Total{}
+	for _, qcfg := range queries {
+		target := qcfg.Template.Sheet
+		if book != nil {
+			target = sheet
+		}
+
+		n, cols, err := RunQuery(qctx, qcfg, state, db, bindType, values, tpl, target, tokens)
+		if err != nil {
+			// don't leave a half written file or sheet behind
+			DiscardPartition(tpl, book, sheet, existing)
+			return nil, err
+		}
+
+		count += n
+		columns = append(columns, cols)
+
+		if cfg.Output.Summary {
+			qtotals, err := PartitionTotals(qcfg, tpl, target, n)
+			if err != nil {
+				DiscardPartition(tpl, book, sheet, existing)
+				return nil, err
+			}
+			totals = append(totals, qtotals...)
+		}
+	}
+
+	if cfg.Output.SkipEmpty && count == 0 {
+		// {num} keeps counting skipped partitions, so each file name stays tied to its partition
+		slog.Info("skipping empty partition")
+		return nil, DiscardPartition(tpl, book, sheet, existing)
+	}
+
+	if book != nil {
+		slog.Info("wrote partition", "partition", label, "rows", count, "file", tpl.Path, "sheet", sheet, "elapsed", time.Since(start).Round(time.Millisecond).String())
+		return &Result{Partition: label, Begin: begin, End: end, File: tpl.Path, Sheet: sheet, Rows: count, Columns: columns, Totals: totals}, nil
+	}
+
+	err = SetProperties(cfg, tpl, tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	if dst == "-" {
+		err = tpl.Write(os.Stdout)
+	} else {
+		err = tpl.Save()
+		if err == nil && tpl.Path != dst {
+			err = os.Rename(tpl.Path, dst)
+		}
+	}
+	if err != nil {
+		DiscardPartition(tpl, book, sheet, existing)
+		return nil, err
+	}
+
+	slog.Info("wrote partition", "partition", label, "rows", count, "file", dst, "elapsed", time.Since(start).Round(time.Millisecond).String())
+	err = PostCommand(ctx, cfg, tokens, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	if capture != nil {
+		csvDst := CsvCopyPath(cfg, tokens)
+		err = WriteCsvCopy(cfg, csvDst, capture)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("wrote partition", "partition", label, "rows", count, "file", csvDst, "elapsed", time.Since(start).Round(time.Millisecond).String())
+		err = PostCommand(ctx, cfg, tokens, csvDst)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := &Result{Partition: label, Begin: begin, End: end, File: dst, Rows: count, Columns: columns, Totals: totals}
+	if capture != nil {
+		res.Copy = CsvCopyPath(cfg, tokens)
+	}
+	return res, nil
+}
+
+func DiscardPartition(
+	tpl *excelize.File,
+	book *excelize.File,
+	sheet string,
+	existing bool,
+) error {
+	if book != nil {
+		book.DeleteSheet(sheet)
+		return nil
+	}
+
+	// an existing workbook filled in place, or one for stdout, is just left unsaved
+	if existing || tpl.Path == "" {
+		return tpl.Close()
+	}
+
+	tpl.Close()
+	return os.Remove(tpl.Path)
+}
+
+// the command is split into arguments before the tokens are replaced, so file
+// names with spaces stay a single argument
+// SplitWords splits a command into its arguments like a shell, so they can be
+// quoted, e.g. "{file}" or 'C:\My Reports', and escaped with a backslash
+func SplitWords(
+	command string,
+) ([]string, error) {
+	args := []string{}
+	word, inWord := []rune{}, false
+	var quote rune
+
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word = append(word, r)
+			}
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else if r == '\\' && i+1 < len(runes) && strings.ContainsRune(`"\$`+"`", runes[i+1]) {
+				i++
+				word = append(word, runes[i])
+			} else {
+				word = append(word, r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == '\\' && i+1 < len(runes):
+			i++
+			word, inWord = append(word, runes[i]), true
+		case unicode.IsSpace(r):
+			if inWord {
+				args = append(args, string(word))
+				word, inWord = []rune{}, false
+			}
+		default:
+			word, inWord = append(word, r), true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unclosed %c quote in command: %s", quote, command)
+	}
+	if inWord {
+		args = append(args, string(word))
+	}
+
+	return args, nil
+}
+
+func PostCommand(
+	ctx context.Context,
+	cfg Config,
+	tokens *strings.Replacer,
+	file string,
+) error {
+	if cfg.Output.PostCommand == "" {
+		return nil
+	}
+
+	args, err := SplitWords(cfg.Output.PostCommand)
+	if err != nil {
+		return err
+	}
+	for i, arg := range args {
+		args[i] = strings.ReplaceAll(tokens.Replace(arg), "{file}", file)
+	}
+
+	slog.Debug("running post command", "args", args)
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if len(out) > 0 {
+		slog.Info("post command output", "file", file, "output", strings.TrimSpace(string(out)))
+	}
+	if err != nil {
+		return fmt.Errorf("post command for %s: %w", file, err)
+	}
+
+	return nil
+}
+
+func RunQuery(
+	ctx context.Context,
+	cfg Config,
+	state *PartitionState,
+	db *sqlx.DB,
+	bindType int,
+	values map[string]string,
+	tpl *excelize.File,
+	sheet string,
+	tokens *strings.Replacer,
+) (int, int, error) {
+	query, args := PartitionQuery(cfg, bindType, values)
+	LogQuery(query, args)
+	rows, err := db.QueryxContext(ctx, query, args...)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	if cfg.Output.Pivot != nil {
+		var closePivot func()
+		rows, closePivot, err = PivotRows(cfg, rows)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer closePivot()
+	}
+
+	names, err := rows.Columns()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if state.Capture != nil {
+		state.Capture.Names, err = ColumnNames(cfg, rows)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	count, err := WriteQuery(cfg, state, tpl, sheet, rows, tokens)
+	return count, len(names), err
+}
+
+// CheckConfig lists the problems of the config, of its template and of the
+// partitions of every source; the database isn't touched
+func CheckConfig(
+	files []string,
+) []error {
+	cfg, err := LoadConfig(files...)
+	if err != nil {
+		// the problems found by Validate come joined, one per line
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			return joined.Unwrap()
+		}
+		return []error{err}
+	}
+
+	problems := []error{}
+	if cfg.Output.Type != "csv" {
+		err = CheckTemplate(cfg)
+		if err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	for _, source := range cfg.Input.Sources {
+		parts := []Partition{source.Partition}
+		if len(source.Partitions) > 0 {
+			parts = source.Partitions
+		}
+		for _, part := range parts {
+			err = CheckPartition(part)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("source %s: %w", SourceLabel(cfg.Input.Type, source), err))
+			}
+		}
+	}
+
+	return problems
+}
+
+// the column partitions without values are only known from the database
+func CheckPartition(
+	part Partition,
+) error {
+	if part.Type == "column" {
+		if len(part.Values) == 0 && (part.Column == "" || part.Table == "") {
+			return errors.New("column partitions require either values or column and table")
+		}
+		return nil
+	}
+
+	parts, err := CreatePartitions(part, nil)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return fmt.Errorf("no partitions from %s to %s", part.Begin, part.End)
+	}
+
+	return nil
+}
+
+// the sheets of a workbook are listed each with the size of the whole file
+func NewManifest(
+	results []Result,
+	extra []string,
+) Manifest {
+	res := Manifest{Files: []ManifestFile{}, Partitions: len(results)}
+
+	add := func(file ManifestFile) {
+		if info, err := os.Stat(file.File); err == nil && file.File != "-" {
+			file.Bytes = info.Size()
+		}
+		res.Files = append(res.Files, file)
+	}
+
+	for _, r := range results {
+		file := ManifestFile{File: r.File, Sheet: r.Sheet, Partition: r.Partition, Begin: r.Begin, End: r.End, Rows: r.Rows}
+		add(file)
+		if r.Copy != "" {
+			file.File = r.Copy
+			add(file)
+		}
+		res.Rows += r.Rows
+	}
+	for _, file := range extra {
+		add(ManifestFile{File: file})
+	}
+
+	return res
+}
+
+func SaveManifest(
+	path string,
+	manifest Manifest,
+) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// the run log gets the info records, along with the queries whatever the log level
+var runLog *slog.Logger
+
+// a relative log-file goes to the output dir
+func RunLogPath(
+	cfg Config,
+) string {
+	path := cfg.Output.LogFile
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(cfg.Output.Dir, path)
+	}
+
+	return path
+}
+
+// OpenRunLog writes a json record per line to the output log-file, starting
+// with the config and version, and returns the function closing it
+func OpenRunLog(
+	cfg Config,
+	configs []string,
+) (func(), error) {
+	file, err := os.Create(RunLogPath(cfg))
+	if err != nil {
+		return nil, err
+	}
+
+	prev := slog.Default()
+	handler := slog.NewJSONHandler(file, &slog.HandlerOptions{Level: slog.LevelInfo})
+	runLog = slog.New(handler)
+	slog.SetDefault(slog.New(TeeHandler{prev.Handler(), handler}))
+
+	// the config files as written, without the expanded secrets
+	texts := []string{}
+	for _, config := range configs {
+		if config != "-" {
+			data, err := os.ReadFile(config)
+			if err == nil {
+				texts = append(texts, string(data))
+			}
+		}
+	}
+	runLog.Info("started", "version", Version(), "config", strings.Join(configs, " "), "text", strings.Join(texts, "---\n"))
+
+	// the records after closing only go to the previous logger
+	return func() {
+		slog.SetDefault(prev)
+		runLog = nil
+		file.Close()
+	}, nil
+}
+
+func LogQuery(
+	query string,
+	args []interface{},
+) {
+	slog.Debug("running query", "query", query, "args", args)
+	if runLog != nil {
+		runLog.Info("running query", "query", query, "args", args)
+	}
+}
+
+// TeeHandler passes the records on to every handler enabled for their level
+type TeeHandler []slog.Handler
+
+func (t TeeHandler) Enabled(
+	ctx context.Context,
+	level slog.Level,
+) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t TeeHandler) Handle(
+	ctx context.Context,
+	record slog.Record,
+) error {
+	for _, h := range t {
+		if h.Enabled(ctx, record.Level) {
+			err := h.Handle(ctx, record.Clone())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t TeeHandler) WithAttrs(
+	attrs []slog.Attr,
+) slog.Handler {
+	res := TeeHandler{}
+	for _, h := range t {
+		res = append(res, h.WithAttrs(attrs))
+	}
+	return res
+}
+
+func (t TeeHandler) WithGroup(
+	name string,
+) slog.Handler {
+	res := TeeHandler{}
+	for _, h := range t {
+		res = append(res, h.WithGroup(name))
+	}
+	return res
+}
+
+func Fatal(
+	err error,
+) {
+	slog.Error(err.Error())
+	os.Exit(1)
+}
+
+func main() {
+	config := flag.String("config", "", "the yaml config file (use - to read it from stdin)")
+	output := flag.String("output", "", "the output name, overriding the config and source ones, with the same tokens, e.g. \"sales {part.beg}\"")
+	dryRun := flag.Bool("dry-run", false, "print the queries and file names without touching the database or disk")
+	progress := flag.Bool("progress", false, "log a running row counter while writing each partition")
+	limit := flag.Int("limit", 0, "write at most this many rows per partition, for previews")
+	retries := flag.Int("retries", 0, "retry the partitions failing with transient database errors this many times")
+	workers := flag.Int("workers", 0, "the number of partitions processed concurrently (files mode only)")
+	logLevel := flag.String("log-level", "info", "the minimum level of the logged messages: debug, info, warn or error")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	summaryJson := flag.String("summary-json", "", "write the list of generated files, with their partitions, rows and sizes, to this json file")
+	continueOnError := flag.Bool("continue-on-error", false, "log the failed sources and partitions and go on with the rest, exiting with status 3")
+	check := flag.Bool("check", false, "validate the config, template and partitions without connecting to the database, and exit")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [config.yaml...]\n\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println("sql2excel " + Version())
+		return
+	}
+
+	var level slog.Level
+	err := level.UnmarshalText([]byte(*logLevel))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid log level: %s\n", *logLevel)
+		os.Exit(2)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	if level <= slog.LevelInfo {
+		// on stderr, so the output can be piped from stdout
+		fmt.Fprintln(os.Stderr, "sql2excel "+Version()+" - Exports partitioned SQL query results to Microsoft Excel using a template")
+		fmt.Fprintln(os.Stderr, "Copyright 2022 by André Vicentini")
+	}
+
+	// several configs are merged in order, -config being the first one
+	configs := flag.Args()
+	if *config != "" {
+		configs = append([]string{*config}, configs...)
+	}
+	if len(configs) == 0 {
+		flag.Usage()
+		Fatal(errors.New("the yaml config file name must be passed either with -config or as an argument"))
+	}
+
+	if *check {
+		problems := CheckConfig(configs)
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", problem)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		fmt.Printf("%s: ok\n", strings.Join(configs, ", "))
+		return
+	}
+
+	cfg, err := LoadConfig(configs...)
+	if err != nil {
+		Fatal(err)
+	}
+	if *dryRun {
+		cfg.DryRun = true
+	}
+	if *continueOnError {
+		cfg.ContinueOnError = true
+	}
+	if *progress {
+		cfg.Progress = true
+	}
+	if *limit > 0 {
+		cfg.Output.Limit = *limit
+	}
+	if *retries > 0 {
+		cfg.Input.Retries = *retries
+	}
+	if *workers > 0 {
+		cfg.Workers = *workers
+	}
+	if *output != "" {
+		cfg.Output.Name = *output
+		for i := range cfg.Input.Sources {
+			cfg.Input.Sources[i].OutputName = ""
+		}
+		// validated again, as the stdout name - has its own rules
+		err = cfg.Validate()
+		if err != nil {
+			Fatal(err)
+		}
+	}
+
+	if cfg.Output.Type != "csv" {
+		err = CheckTemplate(cfg)
+		if err != nil {
+			Fatal(err)
+		}
+	}
+
+	code, err := Run(cfg, configs, *summaryJson)
+	if err != nil {
+		Fatal(err)
+	}
+	if code != 0 {
+		os.Exit(code)
+	}
+}
+
+// Run writes the outputs of every source, returning the exit status of an
+// interrupted run (130) or of one with failures (3); the errors are returned
+// rather than exiting, so the staging dir, the run log and the unfinished
+// book of the sheets mode are always cleaned up
+func Run(
+	cfg Config,
+	configs []string,
+	summaryJson string,
+) (code int, err error) {
+	// the outputs for a remote dir are written to a local staging one, and
+	// uploaded once the run completes
+	remoteDir := ""
+	if IsRemote(cfg.Output.Dir) && !cfg.DryRun {
+		remoteDir = cfg.Output.Dir
+		cfg.Output.Dir, err = os.MkdirTemp("", "sql2excel-out-*")
+		if err != nil {
+			return 0, err
+		}
+		defer os.RemoveAll(cfg.Output.Dir)
+	}
+
+	if cfg.Output.Dir != "" && !cfg.DryRun {
+		err = os.MkdirAll(cfg.Output.Dir, 0755)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	closeLog := func() {}
+	stagedLog := ""
+	if cfg.Output.LogFile != "" && !cfg.DryRun {
+		closeLog, err = OpenRunLog(cfg, configs)
+		if err != nil {
+			return 0, err
+		}
+		// the error ending the run is logged to the stderr by main
+		defer func() {
+			if err != nil && runLog != nil {
+				runLog.Error(err.Error())
+			}
+			closeLog()
+		}()
+		if remoteDir != "" && !filepath.IsAbs(cfg.Output.LogFile) {
+			stagedLog = RunLogPath(cfg)
+		}
+	}
+
+	// the book of the sheets mode is written under a partial name, and
+	// renamed once finished
+	var book *excelize.File
+	sheets := map[int]string{}
+	bookDst := ""
+	bookDone := false
+	if cfg.Output.Mode == "sheets" && !cfg.DryRun {
+		bookDst = OutputPath(cfg, PartitionTokens(cfg, "", 1, 1, Part{}, "", ""))
+		book, err = CloneTemplate(cfg, PartialPath(bookDst))
+		if err != nil {
+			return 0, err
+		}
+		defer func() {
+			if !bookDone {
+				book.Close()
+				if book.Path != "" {
+					os.Remove(book.Path)
+				}
+			}
+		}()
+	}
+
+	// an interrupt or termination cancels the running queries, the partial
+	// outputs are removed and the completed ones kept
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	results := []Result{}
+	interrupted := func() (int, error) {
+		if remoteDir != "" {
+			slog.Warn("interrupted, nothing was uploaded", "dir", remoteDir)
+		} else {
+			slog.Warn("interrupted, the completed files were kept", "partitions", len(results))
+		}
+		return 130, nil
+	}
+
+	// with continue-on-error, the failed sources and partitions are only logged
+	failures := Failures{}
+	failed := func(err error) bool {
+		var f Failures
+		if errors.As(err, &f) {
+			failures = append(failures, f...)
+			return true
+		}
+		if err != nil && cfg.ContinueOnError {
+			slog.Error("source failed, continuing", "error", err)
+			failures = append(failures, err)
+			return true
+		}
+		return false
+	}
+
+	if cfg.Output.MergeSources {
+		results, err = MergeSources(ctx, cfg)
+		if ctx.Err() != nil {
+			return interrupted()
+		}
+		var f Failures
+		if errors.As(err, &f) {
+			failures = f
+		} else if err != nil {
+			return 0, err
+		}
+	} else {
+		total := 1
+		for _, source := range cfg.Input.Sources {
+
+			var db *sqlx.DB
+			closeDb := func() {}
+			if !cfg.DryRun {
+				err = Retry(ctx, cfg, "source "+SourceLabel(cfg.Input.Type, source), func() (err error) {
+					db, closeDb, err = OpenDb(cfg.Input.Type, source)
+					return err
+				})
+				if err != nil {
+					err = fmt.Errorf("source %s: %w", SourceLabel(cfg.Input.Type, source), err)
+					if failed(err) {
+						continue
+					}
+					return 0, err
+				}
+			}
+
+			partitions, err := SourcePartitions(source, db)
+			if err != nil {
+				closeDb()
+				err = fmt.Errorf("source %s: %w", SourceLabel(cfg.Input.Type, source), err)
+				if failed(err) {
+					continue
+				}
+				return 0, err
+			}
+
+			res, err := Process(ctx, cfg, source, db, total, partitions, book, sheets)
+			closeDb()
+			results = append(results, res...)
+			if ctx.Err() != nil {
+				return interrupted()
+			}
+			total += len(partitions)
+			if failed(err) {
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if book != nil {
+		tokens := PartitionTokens(cfg, "", 1, 1, Part{}, "", "")
+		err = FinishBook(cfg, book, results, tokens)
+		if err == nil && book.Path != "" {
+			err = os.Rename(book.Path, bookDst)
+			for i := range results {
+				if results[i].File == book.Path {
+					results[i].File = bookDst
+				}
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+		bookDone = true
+
+		err = PostCommand(ctx, cfg, tokens, bookDst)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	extra := []string{}
+	if book == nil && !cfg.DryRun {
+		if cfg.Output.Index {
+			err = SaveIndex(cfg, results)
+			if err != nil {
+				return 0, err
+			}
+			extra = append(extra, filepath.Join(cfg.Output.Dir, "index.xlsx"))
+		}
+		if cfg.Output.Summary {
+			err = SaveSummary(cfg, results)
+			if err != nil {
+				return 0, err
+			}
+			extra = append(extra, filepath.Join(cfg.Output.Dir, "summary.xlsx"))
+		}
+	}
+
+	if !cfg.DryRun {
+		manifest := NewManifest(results, extra)
+		if remoteDir != "" {
+			uploaded, err := UploadOutputs(cfg.Output.Dir, remoteDir, stagedLog)
+			if err != nil {
+				return 0, err
+			}
+			for i, file := range manifest.Files {
+				if dst, ok := uploaded[file.File]; ok {
+					manifest.Files[i].File = dst
+				}
+			}
+		}
+
+		if summaryJson != "" {
+			err = SaveManifest(summaryJson, manifest)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		files := map[string]bool{}
+		for _, file := range manifest.Files {
+			files[file.File] = true
+		}
+		slog.Info("finished", "partitions", manifest.Partitions, "rows", manifest.Rows, "files", len(files))
+	}
+
+	if len(failures) > 0 {
+		for _, f := range failures {
+			slog.Error("failed", "error", f)
+		}
+		slog.Warn("finished with failures", "failures", len(failures))
+	}
+
+	// the run log is uploaded last, once closed, so it holds every record of the run
+	if stagedLog != "" {
+		closeLog()
+		_, err = UploadFile(cfg.Output.Dir, stagedLog, remoteDir)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if len(failures) > 0 {
+		return 3, nil
+	}
+	return 0, nil
 }